@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/jnfrati/boquita/internal/logger"
 	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/storage"
 	"github.com/jnfrati/boquita/pkg/controller"
 )
 
@@ -36,11 +38,41 @@ func handleErr(ctx *gin.Context, err error) {
 		Err(err).
 		Msgf("error occured while processing the request")
 
-	ctx.JSON(http.StatusInternalServerError, gin.H{
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, models.ErrInvalidManifest), errors.Is(err, models.ErrInvalidReport):
+		status = http.StatusBadRequest
+	case errors.Is(err, models.ErrUnauthorizedReport):
+		status = http.StatusUnauthorized
+	case errors.Is(err, storage.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, controller.ErrConflict):
+		status = http.StatusConflict
+	}
+
+	ctx.JSON(status, gin.H{
 		"error": err.Error(),
 	})
 }
 
+type CancelExecutionRequest struct {
+	CancelledBy string `json:"cancelled_by"`
+}
+
+type TriggerJobRequest struct {
+	TriggeredBy string            `json:"triggered_by"`
+	Args        []string          `json:"args"`
+	Env         map[string]string `json:"env"`
+}
+
+type PauseJobRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ResumeJobRequest struct {
+	RunNow bool `json:"run_now"`
+}
+
 type ListJobsResponse struct {
 	Jobs []models.Job `json:"jobs"`
 }
@@ -92,6 +124,177 @@ func Start(ctx context.Context, controller *controller.Controller) error {
 		})
 	})
 
+	r.PUT("/v0/jobs/:id", func(ctx *gin.Context) {
+		manifest := new(models.JobManifestV1)
+
+		if err := ctx.ShouldBindBodyWithJSON(manifest); err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		job, err := controller.UpdateJob(ctx, ctx.Param("id"), manifest)
+		if err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, job)
+	})
+
+	r.DELETE("/v0/jobs/:id", func(ctx *gin.Context) {
+		cancelRunning := ctx.Query("cancel_running") == "true"
+		purge := ctx.Query("purge") == "true"
+
+		if err := controller.DeleteJob(ctx, ctx.Param("id"), cancelRunning, purge); err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		ctx.Status(http.StatusNoContent)
+	})
+
+	r.POST("/v0/jobs/:id/trigger", func(ctx *gin.Context) {
+		req := new(TriggerJobRequest)
+
+		// The body is optional, only bind it when something was sent
+		if ctx.Request.ContentLength > 0 {
+			if err := ctx.ShouldBindBodyWithJSON(req); err != nil {
+				handleErr(ctx, err)
+				return
+			}
+		}
+
+		var overrides *models.TriggerOverrides
+		if req.Args != nil || len(req.Env) > 0 {
+			overrides = &models.TriggerOverrides{Args: req.Args, Env: req.Env}
+		}
+
+		execution, err := controller.TriggerJob(ctx, ctx.Param("id"), req.TriggeredBy, overrides)
+		if err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusCreated, execution)
+	})
+
+	r.POST("/v0/jobs/:id/pause", func(ctx *gin.Context) {
+		req := new(PauseJobRequest)
+
+		// The body is optional, only bind it when something was sent
+		if ctx.Request.ContentLength > 0 {
+			if err := ctx.ShouldBindBodyWithJSON(req); err != nil {
+				handleErr(ctx, err)
+				return
+			}
+		}
+
+		job, err := controller.PauseJob(ctx, ctx.Param("id"), req.Reason)
+		if err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, job)
+	})
+
+	r.POST("/v0/jobs/:id/resume", func(ctx *gin.Context) {
+		req := new(ResumeJobRequest)
+
+		// The body is optional, only bind it when something was sent
+		if ctx.Request.ContentLength > 0 {
+			if err := ctx.ShouldBindBodyWithJSON(req); err != nil {
+				handleErr(ctx, err)
+				return
+			}
+		}
+
+		job, err := controller.ResumeJob(ctx, ctx.Param("id"), req.RunNow)
+		if err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, job)
+	})
+
+	r.GET("/v0/jobs/:id/executions/:exec/logs", func(ctx *gin.Context) {
+		jobId := ctx.Param("id")
+		executionId := ctx.Param("exec")
+		follow := ctx.Query("follow") == "true"
+
+		// Followed streams outlive the server WriteTimeout
+		if err := http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{}); err != nil {
+			logger.Global.Debug().Err(err).Msg("couldn't clear write deadline for log stream")
+		}
+
+		execution, err := controller.StreamJobLogs(
+			ctx.Request.Context(),
+			jobId,
+			executionId,
+			follow,
+			func(line string) error {
+				ctx.SSEvent("log", line)
+				ctx.Writer.Flush()
+				return nil
+			},
+		)
+		if err != nil {
+			if !ctx.Writer.Written() {
+				handleErr(ctx, err)
+				return
+			}
+
+			ctx.SSEvent("error", err.Error())
+			return
+		}
+
+		// Without follow the stream also ends while the execution runs, it
+		// only finished when terminal
+		if execution.Status.Terminal() {
+			ctx.SSEvent("end", execution.Status)
+		}
+	})
+
+	r.POST("/v0/executions/:id/cancel", func(ctx *gin.Context) {
+		req := new(CancelExecutionRequest)
+
+		// The body is optional, only bind it when something was sent
+		if ctx.Request.ContentLength > 0 {
+			if err := ctx.ShouldBindBodyWithJSON(req); err != nil {
+				handleErr(ctx, err)
+				return
+			}
+		}
+
+		execution, err := controller.CancelExecution(ctx, ctx.Param("id"), req.CancelledBy)
+		if err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, execution)
+	})
+
+	r.POST("/v0/executions/:id/status", func(ctx *gin.Context) {
+		report := new(models.ExecutionReport)
+
+		if err := ctx.ShouldBindBodyWithJSON(report); err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+
+		execution, err := controller.ReportExecutionStatus(ctx, ctx.Param("id"), token, report)
+		if err != nil {
+			handleErr(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, execution)
+	})
+
 	srv := &http.Server{
 		Addr:           "localhost:3333",
 		Handler:        r,
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/spf13/cobra"
@@ -17,10 +23,14 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"github.com/jnfrati/boquita/api"
+	"github.com/jnfrati/boquita/internal/apply"
+	"github.com/jnfrati/boquita/internal/config"
 	"github.com/jnfrati/boquita/internal/executor"
 	"github.com/jnfrati/boquita/internal/logger"
 	"github.com/jnfrati/boquita/internal/models"
 	"github.com/jnfrati/boquita/internal/queue"
+	"github.com/jnfrati/boquita/internal/schedule"
+	"github.com/jnfrati/boquita/internal/secrets"
 	"github.com/jnfrati/boquita/internal/storage"
 	"github.com/jnfrati/boquita/pkg/controller"
 )
@@ -41,30 +51,99 @@ func main() {
 		Short: "Start a boquita server",
 		Run: func(cmd *cobra.Command, args []string) {
 
+			defaultTimeout, _ := cmd.Flags().GetDuration("default-timeout")
+			workers, _ := cmd.Flags().GetInt("workers")
+			logMaxLines, _ := cmd.Flags().GetInt("log-max-lines")
+			logMaxBytes, _ := cmd.Flags().GetInt("log-max-bytes")
+			dataDir, _ := cmd.Flags().GetString("data-dir")
+			orphanPolicy, _ := cmd.Flags().GetString("orphan-policy")
+			configPath, _ := cmd.Flags().GetString("config")
+			cronSeconds, _ := cmd.Flags().GetBool("cron-seconds")
+			cronDescriptors, _ := cmd.Flags().GetBool("cron-descriptors")
+			defaultJitter, _ := cmd.Flags().GetDuration("default-jitter")
+			secretEnvPrefixes, _ := cmd.Flags().GetStringSlice("secret-env-prefix")
+			secretFileRoots, _ := cmd.Flags().GetStringSlice("secret-file-root")
+
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			secretProvider, err := openSecretProvider(cfg.Secrets)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			switch executor.OrphanPolicy(orphanPolicy) {
+			case executor.OrphanPolicy_Ignore, executor.OrphanPolicy_Delete, executor.OrphanPolicy_Adopt:
+			default:
+				log.Fatalf("unknown orphan policy %q", orphanPolicy)
+			}
+
 			rootCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 			defer stop()
 
 			eg, ctx := errgroup.WithContext(rootCtx)
 
-			jobStorage, err := storage.NewStorage[models.Job](storage.StorageType_Memory)
-			if err != nil {
-				panic(err)
-			}
+			// Cron entries only live in memory, they're registered again
+			// from the jobs on startup
 			cronToJobStorage, err := storage.NewStorage[models.CronToJob](storage.StorageType_Memory)
 			if err != nil {
 				panic(err)
 			}
-			executionStorage, err := storage.NewStorage[models.Execution](storage.StorageType_Memory)
+			var jobStorage storage.Storage[models.Job]
+			var executionStorage storage.Storage[models.Execution]
+			// File storages batch their writes, the last ones are written
+			// on shutdown
+			var flush []func() error
+			if dataDir != "" {
+				// Jobs and executions are persisted so schedules and running
+				// executions can be picked up again after a restart
+				if err := os.MkdirAll(dataDir, 0700); err != nil {
+					panic(err)
+				}
+				jobFiles, err := storage.NewFileStorage[models.Job](filepath.Join(dataDir, "jobs.json"))
+				if err != nil {
+					panic(err)
+				}
+				executionFiles, err := storage.NewFileStorage[models.Execution](filepath.Join(dataDir, "executions.json"))
+				if err != nil {
+					panic(err)
+				}
+				jobStorage, executionStorage = jobFiles, executionFiles
+				flush = append(flush, jobFiles.Flush, executionFiles.Flush)
+			} else {
+				jobStorage, err = storage.NewStorage[models.Job](storage.StorageType_Memory)
+				if err != nil {
+					panic(err)
+				}
+				executionStorage, err = storage.NewStorage[models.Execution](storage.StorageType_Memory)
+			}
 			if err != nil {
 				panic(err)
 			}
 
-			chanQueue := queue.NewChannelQueue[models.Job](uint8(100))
+			chanQueue := queue.NewChannelQueue[models.Trigger](uint8(100))
+
+			resolver := secrets.NewResolver(secretProvider, secrets.ResolverOptions{
+				EnvPrefixes: secretEnvPrefixes,
+				FileRoots:   secretFileRoots,
+			})
 
 			executor, err := executor.NewExecutor(
-				executor.ExecutorPlatform_UnikraftCloud,
 				chanQueue.Client(),
 				executionStorage,
+				executor.Options{
+					DefaultTimeout: defaultTimeout,
+					Workers:        workers,
+					LogMaxLines:    logMaxLines,
+					LogMaxBytes:    logMaxBytes,
+					OrphanPolicy:   executor.OrphanPolicy(orphanPolicy),
+					Unikraft:       cfg.Unikraft,
+					Plugins:        cfg.Plugins,
+					PublicURL:      cfg.PublicURL,
+					Secrets:        resolver,
+				},
 			)
 			if err != nil {
 				panic(err)
@@ -72,9 +151,17 @@ func main() {
 
 			controller := controller.NewController(
 				chanQueue.Client(),
+				executor,
 				jobStorage,
 				cronToJobStorage,
 				executionStorage,
+				controller.Options{
+					Schedule: schedule.ParserOptions{
+						Seconds:     cronSeconds,
+						Descriptors: cronDescriptors,
+					},
+					DefaultJitter: defaultJitter,
+				},
 			)
 
 			eg.Go(func() error {
@@ -86,10 +173,24 @@ func main() {
 			})
 
 			eg.Go(func() error {
+				// Restoring may enqueue missed runs, the executor must
+				// already be pulling so a full queue doesn't block it
+				if err := controller.Restore(ctx); err != nil {
+					return err
+				}
+
 				return api.Start(ctx, controller)
 			})
 
-			if err := eg.Wait(); err != nil {
+			err = eg.Wait()
+
+			for _, f := range flush {
+				if err := f(); err != nil {
+					log.Printf("couldn't persist state: %v", err)
+				}
+			}
+
+			if err != nil {
 				// Don't panic on context cancellation (normal shutdown)
 				if err == context.Canceled {
 					log.Println("Server stopped")
@@ -104,6 +205,19 @@ func main() {
 		},
 	}
 
+	startServer.Flags().Duration("default-timeout", 0, "Maximum run time for executions whose manifest doesn't set a timeout (0, the default, disables it)")
+	startServer.Flags().Int("workers", 4, "Amount of jobs launched in parallel")
+	startServer.Flags().Int("log-max-lines", 10000, "Maximum console lines kept per execution (0 disables the cap)")
+	startServer.Flags().Int("log-max-bytes", 1<<20, "Maximum console bytes kept per execution (0 disables the cap)")
+	startServer.Flags().String("config", "", "Server config file, unikraft profiles default to UKC_TOKEN and UKC_METRO when empty")
+	startServer.Flags().String("data-dir", "", "Directory where state is persisted, kept in memory when empty")
+	startServer.Flags().Bool("cron-seconds", true, "Accept an optional leading seconds field in cron expressions")
+	startServer.Flags().Bool("cron-descriptors", true, "Accept descriptors like @hourly and intervals like \"@every 90s\" in cron expressions")
+	startServer.Flags().Duration("default-jitter", 0, "Window the runs of cron jobs are spread within when their manifest doesn't set a jitter (0 disables it)")
+	startServer.Flags().StringSlice("secret-env-prefix", nil, "Prefix of the server variables env:// references can read, env:// is rejected when unset")
+	startServer.Flags().StringSlice("secret-file-root", nil, "Directory file:// references can read from, file:// is rejected when unset")
+	startServer.Flags().String("orphan-policy", string(executor.OrphanPolicy_Ignore), "What to do with boquita instances without a known execution found on startup (ignore, delete, adopt)")
+
 	var createJobCmd = &cobra.Command{
 		Use:   "create [filepath]",
 		Short: "Create a job",
@@ -112,13 +226,7 @@ func main() {
 			filepath := args[0]
 			filepath = path.Clean(filepath)
 
-			jobManifestYaml, err := os.ReadFile(filepath)
-			if err != nil {
-				log.Fatal(err.Error())
-			}
-
-			job := new(models.JobManifestV1)
-			err = yaml.Unmarshal(jobManifestYaml, job)
+			job, err := loadManifest(filepath)
 			if err != nil {
 				log.Fatal(err.Error())
 			}
@@ -152,8 +260,10 @@ func main() {
 			log.Println("Jobs:")
 			log.Println("-----")
 			for _, job := range jobs {
-				if job.LastExecution != nil {
-					fmt.Printf("• %s (%s)\n  Status: %d\n\n", job.Manifest.Name, job.Id, job.LastExecution.Status)
+				if job.Paused {
+					fmt.Printf("• %s (%s)\n  Status: %s\n\n", job.Manifest.Name, job.Id, "paused")
+				} else if job.LastExecution != nil {
+					fmt.Printf("• %s (%s)\n  Status: %s\n\n", job.Manifest.Name, job.Id, job.LastExecution.Status)
 				} else {
 					fmt.Printf("• %s (%s)\n  Status: %s\n\n", job.Manifest.Name, job.Id, "not executed yet")
 				}
@@ -162,11 +272,318 @@ func main() {
 		},
 	}
 
+	var logsCmd = &cobra.Command{
+		Use:   "logs [job id]",
+		Short: "Print the logs of a job execution",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobId := args[0]
+			executionId, _ := cmd.Flags().GetString("execution")
+			follow, _ := cmd.Flags().GetBool("follow")
+
+			path := fmt.Sprintf("/v0/jobs/%s/executions/%s/logs?follow=%t", jobId, executionId, follow)
+			err := stream(cmd, path, func(event string, data string) {
+				switch event {
+				case "log":
+					fmt.Println(data)
+				case "error":
+					log.Printf("stream failed: %s", data)
+				case "end":
+					log.Printf("execution finished with status %s", data)
+				}
+			})
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+		},
+	}
+	logsCmd.Flags().StringP("execution", "e", controller.LatestExecution, "Execution id, defaults to the latest one")
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep streaming until the execution finishes")
+
+	var cancelCmd = &cobra.Command{
+		Use:   "cancel [execution id]",
+		Short: "Cancel a queued or running execution",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			by, _ := cmd.Flags().GetString("by")
+
+			execution, _, err := mutate[models.Execution](cmd, "/v0/executions/"+args[0]+"/cancel", map[string]string{
+				"cancelled_by": by,
+			})
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			fmt.Printf("Execution %s cancelled by %s\n", execution.Id, execution.CancelledBy)
+		},
+	}
+	cancelCmd.Flags().String("by", os.Getenv("USER"), "Who is cancelling the execution")
+
+	var updateJobCmd = &cobra.Command{
+		Use:   "update [job id] [filepath]",
+		Short: "Replace the manifest of a job",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			manifest, err := loadManifest(path.Clean(args[1]))
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			job, _, err := send[models.Job](cmd, http.MethodPut, "/v0/jobs/"+args[0], manifest)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			fmt.Printf("Job %s updated\n", job.Id)
+		},
+	}
+
+	var deleteJobCmd = &cobra.Command{
+		Use:   "delete [job id]",
+		Short: "Delete a job and its schedule",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cancelRunning, _ := cmd.Flags().GetBool("cancel-running")
+			purge, _ := cmd.Flags().GetBool("purge")
+
+			params := url.Values{}
+			params.Set("cancel_running", strconv.FormatBool(cancelRunning))
+			params.Set("purge", strconv.FormatBool(purge))
+
+			_, _, err := send[struct{}](cmd, http.MethodDelete, "/v0/jobs/"+args[0]+"?"+params.Encode(), nil)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			fmt.Printf("Job %s deleted\n", args[0])
+		},
+	}
+	deleteJobCmd.Flags().Bool("cancel-running", false, "Cancel the queued and running executions of the job")
+	deleteJobCmd.Flags().Bool("purge", false, "Remove the finished executions of the job")
+
+	var applyCmd = &cobra.Command{
+		Use:   "apply",
+		Short: "Create, update or delete jobs to match a set of manifests",
+		Long:  "Jobs are matched with the manifests by name, the plan is shown before being applied",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			file, _ := cmd.Flags().GetString("file")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			prune, _ := cmd.Flags().GetBool("prune")
+
+			files, err := apply.ManifestFiles(file)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			manifests := make([]*models.JobManifestV1, 0, len(files))
+			for _, f := range files {
+				manifest, err := loadManifest(f)
+				if err != nil {
+					log.Fatalf("%s: %v", f, err)
+				}
+				manifests = append(manifests, manifest)
+			}
+
+			jobs, _, err := query[[]models.Job](cmd, "/v0/jobs")
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			actions, err := apply.Plan(manifests, jobs, prune)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			for _, action := range actions {
+				fmt.Println(action)
+				if action.Type == apply.ActionType_Unchanged || action.Type == apply.ActionType_Delete {
+					continue
+				}
+				for _, change := range action.Changes {
+					fmt.Printf("    %s\n", change)
+				}
+			}
+
+			if dryRun {
+				return
+			}
+
+			for _, action := range actions {
+				switch action.Type {
+				case apply.ActionType_Create:
+					_, _, err = mutate[map[string]any](cmd, "/v0/jobs", action.Manifest)
+				case apply.ActionType_Update:
+					_, _, err = send[models.Job](cmd, http.MethodPut, "/v0/jobs/"+action.JobId, action.Manifest)
+				case apply.ActionType_Delete:
+					_, _, err = send[struct{}](cmd, http.MethodDelete, "/v0/jobs/"+action.JobId, nil)
+				}
+				if err != nil {
+					log.Fatalf("couldn't %s: %v", action, err)
+				}
+			}
+		},
+	}
+	applyCmd.Flags().StringP("file", "f", "", "Manifest file, or directory of manifests")
+	applyCmd.Flags().Bool("dry-run", false, "Only show the plan")
+	applyCmd.Flags().Bool("prune", false, "Delete the named jobs missing from the manifests")
+	_ = applyCmd.MarkFlagRequired("file")
+
+	var triggerCmd = &cobra.Command{
+		Use:   "trigger [job id]",
+		Short: "Run a job right away, out of its schedule",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			by, _ := cmd.Flags().GetString("by")
+			runArgs, _ := cmd.Flags().GetStringArray("arg")
+			envs, _ := cmd.Flags().GetStringArray("env")
+
+			req := map[string]any{
+				"triggered_by": by,
+			}
+
+			// Args replace the manifest ones, only send them when given
+			if cmd.Flags().Changed("arg") {
+				req["args"] = runArgs
+			}
+
+			if len(envs) > 0 {
+				env := make(map[string]string, len(envs))
+				for _, e := range envs {
+					k, v, ok := strings.Cut(e, "=")
+					if !ok || k == "" {
+						log.Fatalf("env %q must look like KEY=VALUE", e)
+					}
+					env[k] = v
+				}
+				req["env"] = env
+			}
+
+			execution, _, err := mutate[models.Execution](cmd, "/v0/jobs/"+args[0]+"/trigger", req)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			fmt.Printf("Execution %s queued for job %s\n", execution.Id, execution.JobId)
+		},
+	}
+	triggerCmd.Flags().StringArray("arg", nil, "Argument replacing the manifest args for this run, can be repeated")
+	triggerCmd.Flags().StringArray("env", nil, "KEY=VALUE merged onto the manifest env for this run, can be repeated")
+	triggerCmd.Flags().String("by", os.Getenv("USER"), "Who is triggering the execution")
+
+	var pauseCmd = &cobra.Command{
+		Use:   "pause [job id]",
+		Short: "Stop scheduling a job until it's resumed",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			reason, _ := cmd.Flags().GetString("reason")
+
+			job, _, err := mutate[models.Job](cmd, "/v0/jobs/"+args[0]+"/pause", map[string]string{
+				"reason": reason,
+			})
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			fmt.Printf("Job %s paused\n", job.Id)
+		},
+	}
+	pauseCmd.Flags().String("reason", "", "Why the job is paused, recorded on the job")
+
+	var resumeCmd = &cobra.Command{
+		Use:   "resume [job id]",
+		Short: "Schedule a paused job again",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			now, _ := cmd.Flags().GetBool("now")
+
+			job, _, err := mutate[models.Job](cmd, "/v0/jobs/"+args[0]+"/resume", map[string]bool{
+				"run_now": now,
+			})
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			fmt.Printf("Job %s resumed\n", job.Id)
+		},
+	}
+	resumeCmd.Flags().Bool("now", false, "Also run the job once right away")
+
+	var secretsCmd = &cobra.Command{
+		Use:   "secrets",
+		Short: "Manage the secrets of the local encrypted store",
+	}
+	secretsCmd.PersistentFlags().String("config", "", "Server config file defining the secret store")
+
+	var secretsSetCmd = &cobra.Command{
+		Use:   "set [name] [key] [value]",
+		Short: "Store a secret key, read from stdin when the value is omitted",
+		Long:  "Store a secret key, jobs reference it in their env_map as secret://name/key. A running server reads the change on its next launch, no restart needed",
+		Args:  cobra.RangeArgs(2, 3),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, err := openSecretStore(cmd)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			var value string
+			if len(args) == 3 {
+				value = args[2]
+			} else {
+				// Reading from stdin keeps the value out of the shell history
+				content, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					log.Fatal(err.Error())
+				}
+				value = strings.TrimSuffix(string(content), "\n")
+			}
+
+			if err := store.Set(cmd.Context(), args[0], args[1], value); err != nil {
+				log.Fatal(err.Error())
+			}
+
+			fmt.Printf("Stored secret://%s/%s\n", args[0], args[1])
+		},
+	}
+
+	var secretsDeleteCmd = &cobra.Command{
+		Use:   "delete [name] [key]",
+		Short: "Remove a secret key, or the whole secret when the key is omitted",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, err := openSecretStore(cmd)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			key := ""
+			if len(args) == 2 {
+				key = args[1]
+			}
+
+			if err := store.Delete(cmd.Context(), args[0], key); err != nil {
+				log.Fatal(err.Error())
+			}
+		},
+	}
+
+	secretsCmd.AddCommand(secretsSetCmd)
+	secretsCmd.AddCommand(secretsDeleteCmd)
+
 	// Add commands to root
 	// rootCmd.AddCommand(queryCmd)
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(createJobCmd)
+	rootCmd.AddCommand(updateJobCmd)
+	rootCmd.AddCommand(deleteJobCmd)
+	rootCmd.AddCommand(applyCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(cancelCmd)
+	rootCmd.AddCommand(triggerCmd)
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
 	rootCmd.AddCommand(startServer)
+	rootCmd.AddCommand(secretsCmd)
 
 	// Execute the CLI
 	if err := rootCmd.Execute(); err != nil {
@@ -175,13 +592,50 @@ func main() {
 	}
 }
 
+// openSecretProvider returns the provider of secret:// references, nil when
+// none is configured.
+func openSecretProvider(cfg config.Secrets) (secrets.SecretProvider, error) {
+	switch cfg.Provider {
+	case config.SecretsProvider_File:
+		return secrets.NewFileProvider(cfg.Path), nil
+	case config.SecretsProvider_Store:
+		return secrets.NewStore(cfg.Path, cfg.Key)
+	default:
+		return nil, nil
+	}
+}
+
+// openSecretStore opens the encrypted store of the config given to cmd
+func openSecretStore(cmd *cobra.Command) (*secrets.Store, error) {
+	configPath, _ := cmd.Flags().GetString("config")
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Secrets.Provider != config.SecretsProvider_Store {
+		return nil, fmt.Errorf("the config doesn't use the %s secrets provider", config.SecretsProvider_Store)
+	}
+
+	return secrets.NewStore(cfg.Secrets.Path, cfg.Secrets.Key)
+}
+
 func query[T any](cmd *cobra.Command, path string) (T, *http.Response, error) {
 	host, _ := cmd.Flags().GetString("host")
 
-	res, _ := http.Get(host + path)
-
 	var obj T
 
+	res, err := http.Get(host + path)
+	if err != nil {
+		return obj, res, err
+	}
+	defer res.Body.Close()
+
+	if err := responseErr(res); err != nil {
+		return obj, res, err
+	}
+
 	if err := json.NewDecoder(res.Body).Decode(&obj); err != nil {
 		return obj, res, err
 	}
@@ -190,6 +644,12 @@ func query[T any](cmd *cobra.Command, path string) (T, *http.Response, error) {
 }
 
 func mutate[RT any](cmd *cobra.Command, path string, body any) (RT, *http.Response, error) {
+	return send[RT](cmd, http.MethodPost, path, body)
+}
+
+// send issues a request with body encoded as json, and decodes the response
+// into RT. A nil body sends none, responses without content leave RT empty.
+func send[RT any](cmd *cobra.Command, method string, path string, body any) (RT, *http.Response, error) {
 	var obj RT
 
 	host, _ := cmd.Flags().GetString("host")
@@ -197,20 +657,114 @@ func mutate[RT any](cmd *cobra.Command, path string, body any) (RT, *http.Respon
 
 	bodyJson := bytes.NewBuffer([]byte{})
 
-	err := json.NewEncoder(bodyJson).Encode(body)
+	if body != nil {
+		if err := json.NewEncoder(bodyJson).Encode(body); err != nil {
+			return obj, nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, host+path, bodyJson)
 	if err != nil {
 		return obj, nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.Post(host+path, "application/json", bodyJson)
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return obj, res, err
 	}
+	defer res.Body.Close()
+
+	if err := responseErr(res); err != nil {
+		return obj, res, err
+	}
+
+	if res.StatusCode == http.StatusNoContent {
+		return obj, res, nil
+	}
 
 	if err := json.NewDecoder(res.Body).Decode(&obj); err != nil {
 		return obj, res, err
 	}
 
 	return obj, res, nil
+}
+
+// stream reads a Server-Sent Events response, calling onEvent for every event
+// received until the server closes the stream.
+func stream(cmd *cobra.Command, path string, onEvent func(event string, data string)) error {
+	host, _ := cmd.Flags().GetString("host")
+
+	res, err := http.Get(host + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := responseErr(res); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if len(data) > 0 || event != "" {
+				onEvent(event, strings.Join(data, "\n"))
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimPrefix(strings.TrimPrefix(line, "event:"), " ")
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	return scanner.Err()
+}
+
+// responseErr turns an error response from the server into an error
+func responseErr(res *http.Response) error {
+	if res.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+
+	body := map[string]string{}
+	_ = json.NewDecoder(res.Body).Decode(&body)
+
+	return fmt.Errorf("request failed with status %d: %s", res.StatusCode, body["error"])
+}
+
+// loadManifest reads a yaml job manifest. The yaml is converted to json
+// before decoding so the keys match the json field names used by the API.
+func loadManifest(filepath string) (*models.JobManifestV1, error) {
+	content, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", filepath, err)
+	}
+
+	asJson, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := new(models.JobManifestV1)
+	decoder := json.NewDecoder(bytes.NewReader(asJson))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", filepath, err)
+	}
 
+	return manifest, nil
 }
@@ -0,0 +1,244 @@
+// Package apply plans the changes converging the jobs of a server to a set of
+// manifests. Jobs are identified by their manifest name.
+package apply
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/jnfrati/boquita/internal/models"
+)
+
+// ErrInvalidManifests is returned when the manifests can't be matched with
+// jobs, e.g. two of them share a name.
+var ErrInvalidManifests = errors.New("invalid manifests")
+
+type ActionType string
+
+const (
+	ActionType_Create    ActionType = "create"
+	ActionType_Update    ActionType = "update"
+	ActionType_Delete    ActionType = "delete"
+	ActionType_Unchanged ActionType = "unchanged"
+)
+
+// Action is a step of a plan, applied on a single job
+type Action struct {
+	Type ActionType
+	Name string
+
+	// JobId is the id of the existing job, empty for creations
+	JobId string
+
+	// Manifest is the desired manifest, nil for deletions
+	Manifest *models.JobManifestV1
+
+	// Changes are the manifest fields that differ from the server
+	Changes []Change
+}
+
+func (a Action) String() string {
+	if a.JobId == "" {
+		return fmt.Sprintf("%s %s", a.Type, a.Name)
+	}
+
+	return fmt.Sprintf("%s %s (%s)", a.Type, a.Name, a.JobId)
+}
+
+// Change is a manifest field that differs, named by its json key. From is
+// nil for added fields and To for removed ones.
+type Change struct {
+	Field string
+	From  any
+	To    any
+}
+
+func (c Change) String() string {
+	switch {
+	case c.From == nil:
+		return fmt.Sprintf("+ %s: %s", c.Field, format(c.To))
+	case c.To == nil:
+		return fmt.Sprintf("- %s: %s", c.Field, format(c.From))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.Field, format(c.From), format(c.To))
+	}
+}
+
+func format(v any) string {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(content)
+}
+
+// Plan returns the actions turning current into desired, sorted by name.
+// Jobs missing from desired are only deleted with prune, jobs without a name
+// are never touched.
+func Plan(desired []*models.JobManifestV1, current []models.Job, prune bool) ([]Action, error) {
+	wanted := make(map[string]*models.JobManifestV1, len(desired))
+	for _, manifest := range desired {
+		if manifest.Name == "" {
+			return nil, fmt.Errorf("%w: every manifest needs a name", ErrInvalidManifests)
+		}
+		if _, ok := wanted[manifest.Name]; ok {
+			return nil, fmt.Errorf("%w: name %s is used more than once", ErrInvalidManifests, manifest.Name)
+		}
+		wanted[manifest.Name] = manifest
+	}
+
+	existing := make(map[string]models.Job, len(current))
+	for _, job := range current {
+		if job.Manifest == nil || job.Manifest.Name == "" {
+			continue
+		}
+		if _, ok := existing[job.Manifest.Name]; ok {
+			return nil, fmt.Errorf("%w: several jobs are named %s", ErrInvalidManifests, job.Manifest.Name)
+		}
+		existing[job.Manifest.Name] = job
+	}
+
+	var actions []Action
+	for name, manifest := range wanted {
+		job, ok := existing[name]
+		if !ok {
+			changes, err := Diff(nil, manifest)
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, Action{Type: ActionType_Create, Name: name, Manifest: manifest, Changes: changes})
+			continue
+		}
+
+		changes, err := Diff(job.Manifest, manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		action := Action{Type: ActionType_Update, Name: name, JobId: job.Id, Manifest: manifest, Changes: changes}
+		if len(changes) == 0 {
+			action.Type = ActionType_Unchanged
+		}
+		actions = append(actions, action)
+	}
+
+	for name, job := range existing {
+		if _, ok := wanted[name]; ok || !prune {
+			continue
+		}
+
+		changes, err := Diff(job.Manifest, nil)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, Action{Type: ActionType_Delete, Name: name, JobId: job.Id, Changes: changes})
+	}
+
+	slices.SortFunc(actions, func(a Action, b Action) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return actions, nil
+}
+
+// Diff returns the fields that differ between two manifests, compared as
+// they're sent to the API. A nil manifest has no fields.
+func Diff(from *models.JobManifestV1, to *models.JobManifestV1) ([]Change, error) {
+	a, err := fields(from)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := fields(to)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var changes []Change
+	for _, k := range keys {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			changes = append(changes, Change{Field: k, From: a[k], To: b[k]})
+		}
+	}
+
+	return changes, nil
+}
+
+func fields(manifest *models.JobManifestV1) (map[string]any, error) {
+	values := map[string]any{}
+	if manifest == nil {
+		return values, nil
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &values); err != nil {
+		return nil, err
+	}
+
+	// Fields without a value are the same as missing ones
+	for k, v := range values {
+		if v == nil {
+			delete(values, k)
+		}
+	}
+
+	return values, nil
+}
+
+// ManifestFiles returns the manifest files at path: path itself when it's a
+// file, or the yaml files found under it when it's a directory.
+func ManifestFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() && (filepath.Ext(p) == ".yml" || filepath.Ext(p) == ".yaml") {
+			files = append(files, p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no manifest found in %s", path)
+	}
+
+	return files, nil
+}
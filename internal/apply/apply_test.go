@@ -0,0 +1,120 @@
+package apply_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jnfrati/boquita/internal/apply"
+	"github.com/jnfrati/boquita/internal/helpers"
+	"github.com/jnfrati/boquita/internal/models"
+)
+
+func TestPlan(t *testing.T) {
+	desired := []*models.JobManifestV1{
+		{Name: "report", Image: "report:2", Cron: helpers.Ptr("0 3 * * *")},
+		{Name: "backup", Image: "backup:1", Cron: helpers.Ptr("0 * * * *")},
+		{Name: "cleanup", Image: "cleanup:1"},
+	}
+
+	current := []models.Job{
+		{Id: "job-report", Manifest: &models.JobManifestV1{Name: "report", Image: "report:1", Cron: helpers.Ptr("0 3 * * *")}},
+		{Id: "job-backup", Manifest: &models.JobManifestV1{Name: "backup", Image: "backup:1", Cron: helpers.Ptr("0 * * * *")}},
+		{Id: "job-legacy", Manifest: &models.JobManifestV1{Name: "legacy", Image: "legacy:1"}},
+		{Id: "job-unnamed", Manifest: &models.JobManifestV1{Image: "unnamed:1"}},
+	}
+
+	actions, err := apply.Plan(desired, current, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name   string
+		action apply.ActionType
+		jobId  string
+	}{
+		{name: "backup", action: apply.ActionType_Unchanged, jobId: "job-backup"},
+		{name: "cleanup", action: apply.ActionType_Create},
+		{name: "report", action: apply.ActionType_Update, jobId: "job-report"},
+	}
+
+	if len(actions) != len(expected) {
+		t.Fatalf("expected %d actions, got %v", len(expected), actions)
+	}
+
+	for i, e := range expected {
+		if actions[i].Name != e.name || actions[i].Type != e.action || actions[i].JobId != e.jobId {
+			t.Fatalf("expected %s %s (%s), got %s", e.action, e.name, e.jobId, actions[i])
+		}
+	}
+
+	changes := actions[2].Changes
+	if len(changes) != 1 || changes[0].Field != "image" || changes[0].String() != `~ image: "report:1" -> "report:2"` {
+		t.Fatalf("expected only the image to change, got %v", changes)
+	}
+
+	pruned, err := apply.Plan(desired, current, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned) != 4 || pruned[2].Type != apply.ActionType_Delete || pruned[2].JobId != "job-legacy" {
+		t.Fatalf("expected legacy to be deleted with prune, got %v", pruned)
+	}
+}
+
+func TestPlanInvalidManifests(t *testing.T) {
+	tests := map[string][]*models.JobManifestV1{
+		"duplicate name": {{Name: "report"}, {Name: "report"}},
+		"missing name":   {{Image: "report:1"}},
+	}
+
+	for name, desired := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := apply.Plan(desired, nil, false); !errors.Is(err, apply.ErrInvalidManifests) {
+				t.Fatalf("expected ErrInvalidManifests, got %v", err)
+			}
+		})
+	}
+}
+
+func TestManifestFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"b.yml", "a.yaml", "nested/c.yml", "README.md"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("name: x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := apply.ManifestFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "a.yaml"),
+		filepath.Join(dir, "b.yml"),
+		filepath.Join(dir, "nested", "c.yml"),
+	}
+
+	if len(files) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, files)
+	}
+	for i := range expected {
+		if files[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, files)
+		}
+	}
+
+	single, err := apply.ManifestFiles(expected[0])
+	if err != nil || len(single) != 1 || single[0] != expected[0] {
+		t.Fatalf("expected the file itself, got %v, %v", single, err)
+	}
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/jnfrati/boquita/internal/models"
+)
+
+// DefaultProfile is the name of the profile built from the UKC_TOKEN and
+// UKC_METRO environment variables when the config doesn't define any.
+const DefaultProfile = "default"
+
+// Config is the server configuration file
+type Config struct {
+	Unikraft Unikraft `yaml:"unikraft"`
+
+	// PublicURL is where executor plugins reach the API to report status
+	// changes. Plugins get no callback url when it's empty, running
+	// executions are polled either way.
+	PublicURL string `yaml:"public_url"`
+
+	// Plugins are external executors, keyed by the platform name manifests
+	// select them with.
+	Plugins map[string]Plugin `yaml:"plugins"`
+
+	Secrets Secrets `yaml:"secrets"`
+}
+
+const (
+	// SecretsProvider_File reads secrets from a directory, one file per key
+	SecretsProvider_File = "file"
+	// SecretsProvider_Store reads secrets from an encrypted local store
+	SecretsProvider_Store = "store"
+)
+
+// DefaultSecretsKeyEnv holds the store key when key_env isn't set
+const DefaultSecretsKeyEnv = "BOQUITA_SECRETS_KEY"
+
+// Secrets configures where secret:// references are read from. They can't
+// be resolved when no provider is set.
+type Secrets struct {
+	Provider string `yaml:"provider"`
+
+	// Path is the directory of the file provider, or the store file
+	Path string `yaml:"path"`
+
+	// KeyEnv names the variable holding the base64 encoded store key
+	KeyEnv string `yaml:"key_env"`
+	Key    []byte `yaml:"-"`
+}
+
+// DefaultPluginPollInterval is used by plugins that don't set a poll interval
+const DefaultPluginPollInterval = 10 * time.Second
+
+// Plugin is an external executor speaking the HTTP plugin protocol. Token
+// authenticates requests in both directions.
+type Plugin struct {
+	// Platform is the name manifests select the plugin with, the plugin name
+	// when empty. Several plugins can serve the same platform, jobs choose
+	// between them with selector labels.
+	Platform string            `yaml:"platform"`
+	Labels   map[string]string `yaml:"labels"`
+
+	URL      string `yaml:"url"`
+	Token    string `yaml:"token"`
+	TokenEnv string `yaml:"token_env"`
+
+	// PollInterval is how often running executions are polled
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// Unikraft holds the accounts and metros the unikraft executor can launch
+// instances on.
+type Unikraft struct {
+	// DefaultProfile is used by jobs that don't select one, it can be
+	// omitted when there's a single profile.
+	DefaultProfile string `yaml:"default_profile"`
+
+	Profiles map[string]UnikraftProfile `yaml:"profiles"`
+
+	// Labels are matched against the selector of the jobs
+	Labels map[string]string `yaml:"labels"`
+}
+
+// UnikraftProfile is an account on a metro. The token can be given inline or
+// through an environment variable, so config files don't need to hold it.
+type UnikraftProfile struct {
+	Token    string `yaml:"token"`
+	TokenEnv string `yaml:"token_env"`
+	Metro    string `yaml:"metro"`
+
+	// Metros are the other metros jobs fail over to with the account, the
+	// instances left there are only found on startup when they're listed.
+	Metros []string `yaml:"metros"`
+}
+
+// Load reads the config file at path. An empty path returns the config
+// built from the environment only.
+func Load(path string) (*Config, error) {
+	cfg := new(Config)
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.Unmarshal(content, cfg); err != nil {
+			return nil, fmt.Errorf("couldn't parse config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.Unikraft.resolve(); err != nil {
+		return nil, err
+	}
+
+	for name, plugin := range cfg.Plugins {
+		if err := plugin.resolve(name); err != nil {
+			return nil, err
+		}
+		cfg.Plugins[name] = plugin
+	}
+
+	if err := cfg.Secrets.resolve(); err != nil {
+		return nil, err
+	}
+
+	if !cfg.Unikraft.Enabled() && len(cfg.Plugins) == 0 {
+		return nil, errors.New("no executor configured, set UKC_TOKEN or configure unikraft profiles or plugins")
+	}
+
+	return cfg, nil
+}
+
+// resolve fills the tokens from the environment, adds the default profile
+// when none is configured and checks every profile is usable. The executor
+// is disabled when there's no profile and no UKC_TOKEN.
+func (u *Unikraft) resolve() error {
+	if len(u.Profiles) == 0 {
+		if os.Getenv("UKC_TOKEN") == "" {
+			return nil
+		}
+
+		u.Profiles = map[string]UnikraftProfile{
+			DefaultProfile: {
+				TokenEnv: "UKC_TOKEN",
+				Metro:    os.Getenv("UKC_METRO"),
+			},
+		}
+	}
+
+	for name, profile := range u.Profiles {
+		if profile.TokenEnv != "" && profile.Token == "" {
+			profile.Token = os.Getenv(profile.TokenEnv)
+		}
+
+		if profile.Token == "" {
+			return fmt.Errorf("unikraft profile %s: token missing", name)
+		}
+		if profile.Metro == "" {
+			return fmt.Errorf("unikraft profile %s: metro missing", name)
+		}
+		if slices.Contains(profile.Metros, "") {
+			return fmt.Errorf("unikraft profile %s: metros can't be empty", name)
+		}
+
+		u.Profiles[name] = profile
+	}
+
+	if u.DefaultProfile == "" {
+		if len(u.Profiles) > 1 {
+			return errors.New("unikraft default_profile is required when there's more than one profile")
+		}
+
+		for name := range u.Profiles {
+			u.DefaultProfile = name
+		}
+	}
+
+	if _, ok := u.Profiles[u.DefaultProfile]; !ok {
+		return fmt.Errorf("unikraft default_profile %s doesn't exist", u.DefaultProfile)
+	}
+
+	return nil
+}
+
+// resolve fills the token from the environment and the defaults, and checks
+// the plugin is usable.
+func (p *Plugin) resolve(name string) error {
+	if p.Platform == "" {
+		p.Platform = name
+	}
+	if name == models.DefaultPlatform || p.Platform == models.DefaultPlatform {
+		return fmt.Errorf("plugin %s: %s is reserved for the built-in executor", name, models.DefaultPlatform)
+	}
+
+	if p.URL == "" {
+		return fmt.Errorf("plugin %s: url missing", name)
+	}
+	if _, err := url.Parse(p.URL); err != nil {
+		return fmt.Errorf("plugin %s: %w", name, err)
+	}
+
+	if p.TokenEnv != "" && p.Token == "" {
+		p.Token = os.Getenv(p.TokenEnv)
+	}
+
+	if p.Token == "" {
+		return fmt.Errorf("plugin %s: token missing", name)
+	}
+
+	if p.PollInterval < 0 {
+		return fmt.Errorf("plugin %s: poll_interval can't be negative", name)
+	}
+	if p.PollInterval == 0 {
+		p.PollInterval = DefaultPluginPollInterval
+	}
+
+	return nil
+}
+
+// resolve reads the store key from the environment and checks the provider
+// is usable.
+func (s *Secrets) resolve() error {
+	switch s.Provider {
+	case "":
+		return nil
+	case SecretsProvider_File:
+	case SecretsProvider_Store:
+		if s.KeyEnv == "" {
+			s.KeyEnv = DefaultSecretsKeyEnv
+		}
+
+		key, err := base64.StdEncoding.DecodeString(os.Getenv(s.KeyEnv))
+		if err != nil {
+			return fmt.Errorf("secrets: %s isn't valid base64: %w", s.KeyEnv, err)
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("secrets: store key missing, set %s", s.KeyEnv)
+		}
+		s.Key = key
+	default:
+		return fmt.Errorf("secrets: unknown provider %q", s.Provider)
+	}
+
+	if s.Path == "" {
+		return errors.New("secrets: path missing")
+	}
+
+	return nil
+}
+
+// Enabled reports whether jobs can run on unikraft
+func (u *Unikraft) Enabled() bool {
+	return len(u.Profiles) > 0
+}
+
+// ProfileNames returns the configured profile names, sorted
+func (u *Unikraft) ProfileNames() []string {
+	names := make([]string, 0, len(u.Profiles))
+	for name := range u.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
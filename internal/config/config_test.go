@@ -0,0 +1,213 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jnfrati/boquita/internal/config"
+)
+
+func TestLoadFromEnvironment(t *testing.T) {
+	t.Setenv("UKC_TOKEN", "token")
+	t.Setenv("UKC_METRO", "fra0")
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Unikraft.DefaultProfile != config.DefaultProfile {
+		t.Fatalf("expected the default profile, got %s", cfg.Unikraft.DefaultProfile)
+	}
+
+	profile := cfg.Unikraft.Profiles[config.DefaultProfile]
+	if profile.Token != "token" || profile.Metro != "fra0" {
+		t.Fatalf("unexpected default profile %+v", profile)
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	t.Setenv("WAS_TOKEN", "was-token")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+unikraft:
+  default_profile: fra
+  profiles:
+    fra:
+      token: fra-token
+      metro: fra0
+      metros: [dal0]
+    was:
+      token_env: WAS_TOKEN
+      metro: was1
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cfg.Unikraft.Profiles["was"].Token; got != "was-token" {
+		t.Fatalf("expected token from the environment, got %q", got)
+	}
+
+	if got := cfg.Unikraft.Profiles["fra"].Metros; len(got) != 1 || got[0] != "dal0" {
+		t.Fatalf("expected the failover metros of the profile, got %v", got)
+	}
+}
+
+func TestLoadRequiresDefaultProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+unikraft:
+  profiles:
+    fra: {token: a, metro: fra0}
+    was: {token: b, metro: was1}
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.Load(path); err == nil {
+		t.Fatal("expected an error without default_profile")
+	}
+}
+
+func TestLoadPlugins(t *testing.T) {
+	t.Setenv("UKC_TOKEN", "token")
+	t.Setenv("UKC_METRO", "fra0")
+	t.Setenv("FLY_PLUGIN_TOKEN", "fly-token")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+public_url: https://boquita.example.com
+plugins:
+  fly:
+    url: http://localhost:8080
+    token_env: FLY_PLUGIN_TOKEN
+  nomad:
+    url: http://localhost:8081
+    token: nomad-token
+    poll_interval: 30s
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fly := cfg.Plugins["fly"]
+	if fly.Token != "fly-token" || fly.PollInterval != config.DefaultPluginPollInterval {
+		t.Fatalf("unexpected fly plugin %+v", fly)
+	}
+
+	if got := cfg.Plugins["nomad"].PollInterval; got != 30*time.Second {
+		t.Fatalf("expected a 30s poll interval, got %s", got)
+	}
+}
+
+func TestLoadRejectsReservedPluginName(t *testing.T) {
+	t.Setenv("UKC_TOKEN", "token")
+	t.Setenv("UKC_METRO", "fra0")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+plugins:
+  unikraft: {url: http://localhost:8080, token: a}
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.Load(path); err == nil {
+		t.Fatal("expected an error for a plugin named unikraft")
+	}
+}
+
+func TestLoadPluginsOnly(t *testing.T) {
+	t.Setenv("UKC_TOKEN", "")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+plugins:
+  workers-eu:
+    platform: worker
+    labels: {region: eu}
+    url: http://localhost:8080
+    token: a
+  workers-us:
+    platform: worker
+    labels: {region: us}
+    url: http://localhost:8081
+    token: b
+  nomad:
+    url: http://localhost:8082
+    token: c
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Unikraft.Enabled() {
+		t.Fatal("expected unikraft to be disabled without UKC_TOKEN")
+	}
+
+	if got := cfg.Plugins["workers-eu"].Platform; got != "worker" {
+		t.Fatalf("expected the worker platform, got %s", got)
+	}
+	if got := cfg.Plugins["nomad"].Platform; got != "nomad" {
+		t.Fatalf("expected the platform to default to the plugin name, got %s", got)
+	}
+}
+
+func TestLoadRequiresAnExecutor(t *testing.T) {
+	t.Setenv("UKC_TOKEN", "")
+
+	if _, err := config.Load(""); err == nil {
+		t.Fatal("expected an error without any executor")
+	}
+}
+
+func TestLoadSecretsStore(t *testing.T) {
+	t.Setenv("UKC_TOKEN", "token")
+	t.Setenv("UKC_METRO", "fra0")
+	t.Setenv(config.DefaultSecretsKeyEnv, "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+secrets:
+  provider: store
+  path: /var/lib/boquita/secrets.enc
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Secrets.Key) != 32 {
+		t.Fatalf("expected the key to be read from the environment, got %d bytes", len(cfg.Secrets.Key))
+	}
+
+	t.Setenv(config.DefaultSecretsKeyEnv, "")
+	if _, err := config.Load(path); err == nil {
+		t.Fatal("expected an error without the store key")
+	}
+}
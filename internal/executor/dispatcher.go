@@ -0,0 +1,243 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jnfrati/boquita/internal/logger"
+	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/queue"
+	"github.com/jnfrati/boquita/internal/storage"
+)
+
+// emptyQueueBackoff is how long a worker waits before pulling again from a
+// queue that reported being empty.
+const emptyQueueBackoff = 250 * time.Millisecond
+
+// registration is a backend the dispatcher can route triggers to
+type registration struct {
+	// name identifies the backend, it's recorded on the executions it runs
+	name string
+
+	// platform and labels are matched against the manifests
+	platform string
+	labels   map[string]string
+
+	backend backend
+}
+
+// dispatcher pulls triggers from the queue and routes them to a backend
+// serving the platform their manifest selects, with the labels its selector
+// asks for. Triggers matching several backends are spread between them.
+type dispatcher struct {
+	queueClient queue.Client[models.Trigger]
+
+	executionStorage storage.Storage[models.Execution]
+
+	// backends is sorted by name, so routing is stable between restarts
+	backends []*registration
+
+	// next picks the backend among the matching ones, round robin
+	next atomic.Uint64
+
+	opts Options
+}
+
+func newDispatcher(
+	queueClient queue.Client[models.Trigger],
+	executionStorage storage.Storage[models.Execution],
+	backends []*registration,
+	opts Options,
+) *dispatcher {
+	slices.SortFunc(backends, func(a *registration, b *registration) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	return &dispatcher{
+		queueClient:      queueClient,
+		executionStorage: executionStorage,
+		backends:         backends,
+		opts:             opts,
+	}
+}
+
+func (d *dispatcher) Start(ctx context.Context) error {
+	for _, r := range d.backends {
+		if err := r.backend.reconcile(ctx); err != nil {
+			// Not being able to reconcile shouldn't stop new jobs from running
+			logger.Global.Err(err).Str("executor", r.name).Msg("couldn't reconcile executions from a previous run")
+		}
+	}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	for _, r := range d.backends {
+		eg.Go(func() error {
+			logger.Global.Debug().Str("executor", r.name).Str("platform", r.platform).Msg("starting executor")
+			return errors.Wrapf(r.backend.Start(egCtx), "executor %s", r.name)
+		})
+	}
+
+	workers := max(d.opts.Workers, 1)
+	logger.Global.Debug().Int("workers", workers).Msg("starting launch workers")
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.worker(egCtx)
+		}()
+	}
+
+	// Wait for in-flight launches, so instances being created aren't left
+	// behind without an execution tracking them.
+	wg.Wait()
+
+	return eg.Wait()
+}
+
+// worker pulls triggers and launches them until ctx is done. Pull blocks
+// until a trigger is available, so idle workers don't spin.
+func (d *dispatcher) worker(ctx context.Context) {
+	for {
+		trigger, err := d.queueClient.Pull(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, queue.ErrQueueEmpty) {
+			// Non blocking queue clients, back off before pulling again
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(emptyQueueBackoff):
+			}
+			continue
+		}
+		if err != nil {
+			logger.Global.Err(err).Msg("couldn't pull from queue")
+			continue
+		}
+
+		// The launch is finished even when shutting down, otherwise the
+		// instance could be created with nothing left to record it.
+		d.dispatch(context.WithoutCancel(ctx), trigger)
+	}
+}
+
+// dispatch hands the trigger to one of the backends matching its manifest.
+// Triggers no configured backend can run are recorded as errored.
+func (d *dispatcher) dispatch(ctx context.Context, trigger *models.Trigger) {
+	candidates, err := d.candidates(trigger.Job.Manifest)
+	if err == nil {
+		r := candidates[d.next.Add(1)%uint64(len(candidates))]
+		r.backend.run(ctx, trigger)
+		return
+	}
+
+	execution, loadErr := loadExecution(ctx, d.executionStorage, trigger)
+	if loadErr != nil {
+		logger.Global.Err(loadErr).Str("execution_id", trigger.ExecutionId).Msg("couldn't load queued execution")
+		return
+	}
+
+	if _, err := updateExecution(ctx, d.executionStorage, execution, func(e *models.Execution) error {
+		e.Error = err.Error()
+		return e.Transition(models.ExecutionStatus_ERRORED, err.Error())
+	}); err != nil {
+		logger.Global.Debug().Err(err).Str("execution_id", execution.Id).Msg("skipping execution update")
+	}
+}
+
+// candidates returns the backends that can run the manifest: the ones
+// serving its platform, with the labels of its selector and accepting it.
+func (d *dispatcher) candidates(manifest *models.JobManifestV1) ([]*registration, error) {
+	platform := manifest.PlatformName()
+
+	var (
+		candidates []*registration
+		rejected   error
+	)
+	for _, r := range d.backends {
+		if r.platform != platform || !manifest.SelectorMatches(r.labels) {
+			continue
+		}
+
+		if err := r.backend.Validate(manifest); err != nil {
+			rejected = err
+			continue
+		}
+
+		candidates = append(candidates, r)
+	}
+
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+
+	// Surface why the only matching backends refused the manifest
+	if rejected != nil {
+		return nil, rejected
+	}
+
+	if len(manifest.Selector) > 0 {
+		return nil, fmt.Errorf("%w: no executor available for platform %s with selector %v", models.ErrInvalidManifest, platform, manifest.Selector)
+	}
+
+	return nil, fmt.Errorf("%w: no executor available for platform %s", models.ErrInvalidManifest, platform)
+}
+
+// backend returns the backend an execution was routed to. Executions stored
+// before executors were recorded ran on unikraft.
+func (d *dispatcher) backend(execution *models.Execution) (backend, error) {
+	name := execution.Executor
+	if name == "" {
+		name = models.DefaultPlatform
+	}
+
+	for _, r := range d.backends {
+		if r.name == name {
+			return r.backend, nil
+		}
+	}
+
+	return nil, fmt.Errorf("executor %s isn't configured", name)
+}
+
+// Validate checks a configured backend can run the manifest, so jobs for
+// unavailable platforms are rejected when created.
+func (d *dispatcher) Validate(manifest *models.JobManifestV1) error {
+	_, err := d.candidates(manifest)
+	return err
+}
+
+func (d *dispatcher) Cancel(ctx context.Context, execution *models.Execution) error {
+	b, err := d.backend(execution)
+	if err != nil {
+		return err
+	}
+
+	return b.Cancel(ctx, execution)
+}
+
+func (d *dispatcher) Report(ctx context.Context, execution *models.Execution, token string, report *models.ExecutionReport) error {
+	b, err := d.backend(execution)
+	if err != nil {
+		return err
+	}
+
+	r, ok := b.(reporter)
+	if !ok {
+		return errors.Wrapf(models.ErrUnauthorizedReport, "executor %s doesn't accept status reports", execution.Executor)
+	}
+
+	return r.report(ctx, execution, token, report)
+}
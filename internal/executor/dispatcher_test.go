@@ -0,0 +1,271 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jnfrati/boquita/internal/helpers"
+	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/queue"
+	"github.com/jnfrati/boquita/internal/storage"
+)
+
+// fakeBackend records the executions routed to it. validateErr rejects every
+// manifest when set, and runs wait for release to be closed when it's set.
+type fakeBackend struct {
+	validateErr error
+	release     chan struct{}
+
+	mux        sync.Mutex
+	reconciled bool
+	ran        []string
+	running    int
+	peak       int
+}
+
+func (f *fakeBackend) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeBackend) reconcile(context.Context) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.reconciled = true
+	return nil
+}
+
+func (f *fakeBackend) Validate(*models.JobManifestV1) error {
+	return f.validateErr
+}
+
+func (f *fakeBackend) Cancel(context.Context, *models.Execution) error {
+	return nil
+}
+
+func (f *fakeBackend) run(ctx context.Context, trigger *models.Trigger) {
+	f.mux.Lock()
+	f.ran = append(f.ran, trigger.ExecutionId)
+	f.running++
+	f.peak = max(f.peak, f.running)
+	f.mux.Unlock()
+
+	if f.release != nil {
+		<-f.release
+	}
+
+	f.mux.Lock()
+	f.running--
+	f.mux.Unlock()
+}
+
+// runs returns how many triggers were handed to the backend, and the most it
+// ran at once.
+func (f *fakeBackend) runs() (int, int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return len(f.ran), f.peak
+}
+
+func newTestDispatcher(t *testing.T, backends []*registration, opts Options) (*dispatcher, storage.Storage[models.Execution], queue.Client[models.Trigger]) {
+	t.Helper()
+
+	executionStorage, err := storage.NewStorage[models.Execution](storage.StorageType_Memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queueClient := queue.NewChannelQueue[models.Trigger](16).Client()
+
+	return newDispatcher(queueClient, executionStorage, backends, opts), executionStorage, queueClient
+}
+
+// testRegistrations returns a unikraft backend and three worker plugins, two
+// of them in the eu region.
+func testRegistrations() []*registration {
+	return []*registration{
+		{name: "workers-us", platform: "worker", labels: map[string]string{"region": "us"}, backend: &fakeBackend{}},
+		{name: "workers-eu-2", platform: "worker", labels: map[string]string{"region": "eu"}, backend: &fakeBackend{}},
+		{name: models.DefaultPlatform, platform: models.DefaultPlatform, backend: &fakeBackend{}},
+		{name: "workers-eu-1", platform: "worker", labels: map[string]string{"region": "eu", "tier": "gpu"}, backend: &fakeBackend{}},
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	rejected := errors.New("image missing")
+
+	tests := []struct {
+		name     string
+		platform *string
+		selector map[string]string
+		rejected bool
+		expected []string
+		err      error
+	}{
+		{name: "default platform", expected: []string{models.DefaultPlatform}},
+		{name: "platform", platform: helpers.Ptr("worker"), expected: []string{"workers-eu-1", "workers-eu-2", "workers-us"}},
+		{name: "selector", platform: helpers.Ptr("worker"), selector: map[string]string{"region": "eu"}, expected: []string{"workers-eu-1", "workers-eu-2"}},
+		{name: "several labels", platform: helpers.Ptr("worker"), selector: map[string]string{"region": "eu", "tier": "gpu"}, expected: []string{"workers-eu-1"}},
+		{name: "selector matching nothing", platform: helpers.Ptr("worker"), selector: map[string]string{"region": "ap"}, err: models.ErrInvalidManifest},
+		{name: "selector of another platform", selector: map[string]string{"region": "eu"}, err: models.ErrInvalidManifest},
+		{name: "unknown platform", platform: helpers.Ptr("fly"), err: models.ErrInvalidManifest},
+		{name: "rejected by the backend", rejected: true, err: rejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := testRegistrations()
+			if tt.rejected {
+				backends[2].backend = &fakeBackend{validateErr: rejected}
+			}
+			d, _, _ := newTestDispatcher(t, backends, Options{})
+
+			manifest := &models.JobManifestV1{Name: "job", Platform: tt.platform, Selector: tt.selector}
+			candidates, err := d.candidates(manifest)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			var names []string
+			for _, r := range candidates {
+				names = append(names, r.name)
+			}
+			if !slices.Equal(names, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, names)
+			}
+
+			if err := d.Validate(manifest); !errors.Is(err, tt.err) {
+				t.Fatalf("expected validation to fail with %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestDispatchRoundRobin(t *testing.T) {
+	backends := testRegistrations()
+	d, _, _ := newTestDispatcher(t, backends, Options{})
+
+	manifest := &models.JobManifestV1{Name: "job", Platform: helpers.Ptr("worker"), Selector: map[string]string{"region": "eu"}}
+	for _, id := range []string{"exec-1", "exec-2", "exec-3", "exec-4"} {
+		d.dispatch(t.Context(), &models.Trigger{ExecutionId: id, Job: &models.Job{Id: "job", Manifest: manifest}})
+	}
+
+	expected := map[string][]string{
+		"workers-eu-1": {"exec-2", "exec-4"},
+		"workers-eu-2": {"exec-1", "exec-3"},
+	}
+	for _, r := range backends {
+		if ran := r.backend.(*fakeBackend).ran; !slices.Equal(ran, expected[r.name]) {
+			t.Fatalf("expected %s to run %v, got %v", r.name, expected[r.name], ran)
+		}
+	}
+}
+
+func TestDispatchWithoutCandidate(t *testing.T) {
+	backends := testRegistrations()
+	d, executionStorage, _ := newTestDispatcher(t, backends, Options{})
+
+	execution := models.NewExecution("exec", "job")
+	if err := executionStorage.Set(t.Context(), execution.Id, execution); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &models.JobManifestV1{Name: "job", Platform: helpers.Ptr("fly")}
+	d.dispatch(t.Context(), &models.Trigger{ExecutionId: "exec", Job: &models.Job{Id: "job", Manifest: manifest}})
+
+	stored, err := executionStorage.Get(t.Context(), "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.ExecutionStatus_ERRORED {
+		t.Fatalf("expected %s, got %s", models.ExecutionStatus_ERRORED, stored.Status)
+	}
+	if !strings.Contains(stored.Error, "no executor available for platform fly") {
+		t.Fatalf("expected the missing executor to be recorded, got %q", stored.Error)
+	}
+
+	for _, r := range backends {
+		if ran, _ := r.backend.(*fakeBackend).runs(); ran > 0 {
+			t.Fatalf("expected no backend to run the execution, %s ran %d", r.name, ran)
+		}
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	tests := []struct {
+		workers  int
+		expected int
+	}{
+		{workers: 0, expected: 1},
+		{workers: 1, expected: 1},
+		{workers: 3, expected: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.workers), func(t *testing.T) {
+			backend := &fakeBackend{release: make(chan struct{})}
+			registrations := []*registration{{name: models.DefaultPlatform, platform: models.DefaultPlatform, backend: backend}}
+			d, _, queueClient := newTestDispatcher(t, registrations, Options{Workers: tt.workers})
+
+			const triggers = 6
+			manifest := &models.JobManifestV1{Name: "job"}
+			for i := range triggers {
+				if err := queueClient.Push(&models.Trigger{ExecutionId: "exec-" + strconv.Itoa(i), Job: &models.Job{Id: "job", Manifest: manifest}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(t.Context())
+			done := make(chan error, 1)
+			go func() {
+				done <- d.Start(ctx)
+			}()
+
+			// Every worker picks a trigger and blocks on it, the others wait
+			// in the queue.
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				if ran, _ := backend.runs(); ran >= tt.expected || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			if ran, peak := backend.runs(); ran != tt.expected || peak != tt.expected {
+				t.Errorf("expected %d launches at once, got %d running out of %d", tt.expected, peak, ran)
+			}
+
+			close(backend.release)
+			deadline = time.Now().Add(5 * time.Second)
+			for {
+				if ran, _ := backend.runs(); ran == triggers || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			// Start returned, every launch is over
+			if !backend.reconciled {
+				t.Fatal("expected the backend to be reconciled on start")
+			}
+
+			if ran, peak := backend.runs(); ran != triggers || peak != tt.expected {
+				t.Fatalf("expected %d launches with at most %d at once, got %d with %d", triggers, tt.expected, ran, peak)
+			}
+		})
+	}
+}
@@ -2,235 +2,212 @@ package executor
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"maps"
 	"time"
 
-	"github.com/google/uuid"
-	"github.com/pkg/errors"
-	kraftcloud "sdk.kraft.cloud"
-	kcinstance "sdk.kraft.cloud/instances"
-
-	"github.com/jnfrati/boquita/internal/helpers"
-	"github.com/jnfrati/boquita/internal/logger"
+	"github.com/jnfrati/boquita/internal/config"
 	"github.com/jnfrati/boquita/internal/models"
 	"github.com/jnfrati/boquita/internal/queue"
+	"github.com/jnfrati/boquita/internal/secrets"
 	"github.com/jnfrati/boquita/internal/storage"
+	"github.com/jnfrati/boquita/internal/templating"
 )
 
 type Executor interface {
 	Start(context.Context) error
-}
-
-type executorPlatform uint
-
-const (
-	ExecutorPlatform_UnikraftCloud executorPlatform = iota
-)
 
-func NewExecutor(platform executorPlatform, queue queue.Client[models.Job], executionStorage storage.Storage[models.Execution]) (Executor, error) {
-	switch platform {
-	case ExecutorPlatform_UnikraftCloud:
-		return newUnikraftExecutor(queue, executionStorage)
-	default:
-		return nil, nil
-	}
-}
-
-type unikraftExecutor struct {
-	kraftcloud kraftcloud.KraftCloud
+	// Validate checks the manifest can be run by this executor, so jobs that
+	// could never run are rejected when created.
+	Validate(*models.JobManifestV1) error
 
-	queueClient queue.Client[models.Job]
+	// Cancel stops an execution that already left the queue, removing
+	// whatever is running it on the platform.
+	Cancel(context.Context, *models.Execution) error
 
-	executionStorage storage.Storage[models.Execution]
+	// Report applies a status change sent by the platform running the
+	// execution. token authenticates the platform.
+	Report(ctx context.Context, execution *models.Execution, token string, report *models.ExecutionReport) error
 }
 
-func newUnikraftExecutor(queueClient queue.Client[models.Job], executionStorage storage.Storage[models.Execution]) (*unikraftExecutor, error) {
-	kraftToken, ok := os.LookupEnv("UKC_TOKEN")
-	if !ok {
-		return nil, errors.New("UKC_TOKEN missing, can't start unikraft executor")
-	}
-
-	logger.Global.Debug().Msgf("UKC_TOKEN=%s", kraftToken)
-
-	kraftMetro, ok := os.LookupEnv("UKC_METRO")
-	if !ok {
-		return nil, errors.New("UKC_METRO missing, can't start unikraft executor")
-	}
-
-	logger.Global.Debug().Msgf("UKC_METRO=%s", kraftMetro)
+// backend runs the executions routed to it by the dispatcher. Start only
+// runs its background work, the dispatcher pulls the triggers.
+type backend interface {
+	Start(context.Context) error
 
-	client := kraftcloud.NewClient(
-		kraftcloud.WithToken(kraftToken),
-		kraftcloud.WithDefaultMetro(kraftMetro),
-	)
+	// reconcile picks up the executions left by a previous run, it's called
+	// before any trigger is dispatched.
+	reconcile(context.Context) error
 
-	return &unikraftExecutor{
-		kraftcloud:       client,
-		queueClient:      queueClient,
-		executionStorage: executionStorage,
-	}, nil
+	Validate(*models.JobManifestV1) error
+	Cancel(context.Context, *models.Execution) error
 
+	// run launches the execution of a trigger pulled from the queue
+	run(context.Context, *models.Trigger)
 }
 
-func (ue *unikraftExecutor) Start(ctx context.Context) error {
-	client := ue.kraftcloud
-
-	ticker := time.NewTicker(time.Millisecond * 250)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-		}
+// reporter is implemented by the backends that accept status reports
+type reporter interface {
+	report(ctx context.Context, execution *models.Execution, token string, report *models.ExecutionReport) error
+}
 
-		job, err := ue.queueClient.Pull(ctx)
-		if errors.Is(err, queue.ErrQueueEmpty) || errors.Is(err, context.Canceled) {
-			continue
-		}
+// Options holds the server wide settings shared by every executor platform.
+type Options struct {
+	// DefaultTimeout is applied to executions whose manifest doesn't set a
+	// timeout. Zero means executions can run forever.
+	DefaultTimeout time.Duration
 
-		logger.Global.Debug().Msgf("Received new job name %s ", job.Manifest.Name)
+	// Workers is how many triggers are launched in parallel, at least one
+	// worker is always started.
+	Workers int
 
-		// Hydrate the job manifest
+	// LogMaxLines and LogMaxBytes cap the console output kept per
+	// execution, older lines are dropped first. Zero disables the cap.
+	LogMaxLines int
+	LogMaxBytes int
 
-		manifest := job.Manifest
+	// OrphanPolicy decides what to do on startup with instances that carry
+	// the boquita name prefix but have no matching execution. Other instances
+	// of the account are never touched.
+	OrphanPolicy OrphanPolicy
 
-		execId := uuid.NewString()
+	// Unikraft holds the accounts and metros of the unikraft executor
+	Unikraft config.Unikraft
 
-		instanceName := manifest.Name + execId
+	// Plugins are the external executors, keyed by platform name
+	Plugins map[string]config.Plugin
 
-		logger.Global.Debug().Msgf("Creating instance")
-		res, err := client.Instances().Create(ctx, kcinstance.CreateRequest{
-			Name:      &instanceName,
-			Image:     manifest.Image,
-			Args:      manifest.Args,
-			Env:       manifest.EnvMap,
-			MemoryMB:  manifest.MemoryMB,
-			Autostart: helpers.Ptr(true),
-		})
-		if err != nil {
-			return err
-		}
+	// PublicURL is the API address sent to plugins for status callbacks
+	PublicURL string
 
-		if len(res.Errors) > 0 {
-			errlist := make([]error, len(res.Errors))
+	// Secrets resolves the secret references of the manifests env, a nil
+	// resolver rejects every reference.
+	Secrets *secrets.Resolver
+}
 
-			for _, err := range res.Errors {
-				errlist = append(errlist, fmt.Errorf("couldn't create instance, error status: %v", err.Status))
-			}
+type OrphanPolicy string
 
-			return errlist[0]
-		}
+const (
+	// OrphanPolicy_Ignore leaves unknown instances untouched
+	OrphanPolicy_Ignore OrphanPolicy = "ignore"
+	// OrphanPolicy_Delete removes unknown instances
+	OrphanPolicy_Delete OrphanPolicy = "delete"
+	// OrphanPolicy_Adopt records an execution for unknown instances and
+	// observes them until they finish
+	OrphanPolicy_Adopt OrphanPolicy = "adopt"
+)
 
-		execution := &models.Execution{
-			Id:         execId,
-			JobId:      job.Id,
-			StartedAt:  time.Now(),
-			Status:     models.ExecutionStatus_RUNNING,
-			ExitCode:   nil,
-			FinishedAt: nil,
-			Logs:       []string{},
-		}
+// NewExecutor returns the executor running every configured backend: the
+// built-in unikraft one and the plugins. Triggers are routed by the platform
+// and selector of their manifest.
+func NewExecutor(queue queue.Client[models.Trigger], executionStorage storage.Storage[models.Execution], opts Options) (Executor, error) {
+	backends := make([]*registration, 0, len(opts.Plugins)+1)
 
-		err = ue.executionStorage.Set(ctx, execId, execution)
+	if opts.Unikraft.Enabled() {
+		unikraft, err := newUnikraftExecutor(executionStorage, opts)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		entry := res.Data.Entries[0]
+		backends = append(backends, &registration{
+			name:     models.DefaultPlatform,
+			platform: models.DefaultPlatform,
+			labels:   opts.Unikraft.Labels,
+			backend:  unikraft,
+		})
+	}
+
+	for name, plugin := range opts.Plugins {
+		backends = append(backends, &registration{
+			name:     name,
+			platform: plugin.Platform,
+			labels:   plugin.Labels,
+			backend:  newPluginExecutor(name, plugin, executionStorage, opts),
+		})
+	}
 
-		logger.Global.Debug().Any("execution", execution).Any("entry", entry).Msg("Starting observable")
-		go func() {
-			err := ue.ObserveJob(ctx, execution, entry.UUID)
-			if err != nil {
-				// TODO: Cleanup instance and update execution
-				logger.Global.Err(err).Msg("failed to observe job")
-			}
-		}()
+	if len(backends) == 0 {
+		return nil, errors.New("no executor configured")
 	}
 
+	return newDispatcher(queue, executionStorage, backends, opts), nil
 }
 
-func (ue *unikraftExecutor) ObserveJob(ctx context.Context, execution *models.Execution, kinstanceId string) error {
-	logger.Global.Debug().Msg("starting observer")
-	defer logger.Global.Debug().Msg("closing observer")
+// render returns the manifest an execution is launched with: args, command
+// and env expanded with the execution context, the standard BOQUITA_*
+// variables added and secret references resolved. The job manifest is left
+// untouched, the result holds secrets and must never be stored.
+func render(ctx context.Context, manifest *models.JobManifestV1, jobId string, execution *models.Execution, resolver *secrets.Resolver) (*models.JobManifestV1, error) {
+	data := templating.Context{
+		ExecutionId:   execution.Id,
+		JobId:         jobId,
+		JobName:       manifest.Name,
+		ScheduledTime: execution.ScheduledAt,
+		Attempt:       execution.Attempt,
+	}
 
-	ticker := time.NewTicker(time.Second * 5)
-	defer ticker.Stop()
+	rendered := *manifest
 
-	for {
-		select {
-		case <-ctx.Done():
-			// NOTE: Store latest state maybe?
-			return nil
-		case <-ticker.C:
+	var err error
+	if rendered.Args, err = templating.ExpandArgs(manifest.Args, data); err != nil {
+		return nil, err
+	}
+	if rendered.Command, err = templating.ExpandArgs(manifest.Command, data); err != nil {
+		return nil, err
+	}
 
+	// Only values holding a reference as written are resolved. A template
+	// expanding into a reference is kept as is, or it could read secrets
+	// the manifest doesn't reference. Secret values are never interpreted as
+	// templates either.
+	env := make(map[string]string, len(manifest.EnvMap))
+	for k, v := range manifest.EnvMap {
+		if templating.IsTemplate(v) {
+			v, err = templating.Expand(v, data)
+		} else {
+			v, err = resolver.Resolve(ctx, v)
 		}
-		retryCount := 0
-	retry:
-
-		logger.Global.Debug().Msg("Getting instances")
-		instanceRes, err := ue.kraftcloud.Instances().Get(ctx, kinstanceId)
 		if err != nil {
-			if retryCount > 3 {
-				logger.Global.Debug().Err(err).Msg("failed to retrieve instances three times, stopping observer")
-				return errors.Wrap(err, "Retried 3 times, closing observer with error")
-			}
-
-			logger.Global.Debug().Err(err).Msg("failed to retrieve instances, retrying")
-			time.Sleep(2 * time.Second)
-			retryCount++
-			goto retry
+			return nil, fmt.Errorf("env %s: %w", k, err)
 		}
 
-		logger.Global.
-			Debug().
-			Any("execution", execution).
-			Any("instance", instanceRes).
-			Msg("Got instance from unikraft")
+		env[k] = v
+	}
 
-		instance := instanceRes.Data.Entries[0]
+	// The standard variables win, jobs can rely on them
+	maps.Copy(env, templating.Env(data))
+	rendered.EnvMap = env
 
-		if instance.Error != nil {
-			// TODO: Manage error updating the instance
-			logger.Global.Error().
-				Str("error_message", instance.Message).
-				Msgf("retrieving instance failed, stopping observer")
-			return nil
-		}
+	return &rendered, nil
+}
 
-		execution.ExitCode = instance.ExitCode
-		if instance.StoppedAt == "" {
-			execution.Status = models.ExecutionStatus_RUNNING
-		} else if *execution.ExitCode > 0 {
-			execution.Status = models.ExecutionStatus_FAILED
-		} else if *execution.ExitCode == 0 {
-			execution.Status = models.ExecutionStatus_SUCCEEDED
-		}
+// loadExecution returns the queued execution of a trigger, recreating it when
+// it's missing from the storage.
+func loadExecution(ctx context.Context, executionStorage storage.Storage[models.Execution], trigger *models.Trigger) (*models.Execution, error) {
+	execution, err := executionStorage.Get(ctx, trigger.ExecutionId)
+	if errors.Is(err, storage.ErrNotFound) {
+		execution = models.NewExecution(trigger.ExecutionId, trigger.Job.Id)
+		execution.Platform = trigger.Job.Manifest.PlatformName()
+		return execution, nil
+	}
 
-		err = ue.executionStorage.Set(ctx, execution.Id, execution)
-		if err != nil {
-			logger.Global.Debug().Err(err).Any("execution", execution).Msg("couldn't update execution")
-		}
+	return execution, err
+}
 
-		if execution.Status != models.ExecutionStatus_RUNNING {
-			retryCount = 0
-		retrydelete:
-			// Remove the instance
-			_, err := ue.kraftcloud.Instances().Delete(ctx, kinstanceId)
-			if err != nil {
-				if retryCount > 3 {
-					logger.Global.Debug().Err(err).Msg("failed to delete instance three times, stopping observer")
-					return errors.Wrap(err, "Retried 3 times, closing observer with error")
-				}
-
-				logger.Global.Debug().Err(err).Msg("failed to delete instance, retrying")
-				time.Sleep(2 * time.Second)
-				retryCount++
-				goto retrydelete
-			}
-		}
+// updateExecution applies fn to the stored version of execution and stores
+// the result, nothing is stored when fn fails, e.g. because the execution was
+// cancelled in the meantime. Executions that aren't stored yet are taken as
+// is. The execution is returned as stored, also when fn fails.
+func updateExecution(ctx context.Context, executionStorage storage.Storage[models.Execution], execution *models.Execution, fn func(*models.Execution) error) (*models.Execution, error) {
+	stored, err := executionStorage.Update(ctx, execution.Id, fn)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return stored, err
+	}
+
+	if err := fn(execution); err != nil {
+		return execution, err
 	}
 
+	return execution, executionStorage.Set(ctx, execution.Id, execution)
 }
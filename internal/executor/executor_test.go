@@ -0,0 +1,53 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/secrets"
+)
+
+func TestRenderEnv(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "database"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "database", "password"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := secrets.NewResolver(secrets.NewFileProvider(dir), secrets.ResolverOptions{})
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "plain", value: "full", expected: "full"},
+		{name: "reference", value: "secret://database/password", expected: "hunter2"},
+		{name: "template", value: "run-{{ .ExecutionId }}", expected: "run-exec"},
+		{name: "template expanding into a reference", value: `{{ "secret://database/password" }}`, expected: "secret://database/password"},
+		{name: "reference built by a template", value: `secret://{{ "database" }}/password`, expected: "secret://database/password"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := &models.JobManifestV1{Name: "job", EnvMap: map[string]string{"VALUE": tt.value}}
+
+			rendered, err := render(t.Context(), manifest, "job", models.NewExecution("exec", "job"), resolver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v := rendered.EnvMap["VALUE"]; v != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, v)
+			}
+
+			if manifest.EnvMap["VALUE"] != tt.value {
+				t.Fatal("expected the manifest to be left untouched")
+			}
+		})
+	}
+}
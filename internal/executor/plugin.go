@@ -0,0 +1,454 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jnfrati/boquita/internal/config"
+	"github.com/jnfrati/boquita/internal/helpers"
+	"github.com/jnfrati/boquita/internal/logger"
+	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/storage"
+)
+
+// errPluginNotFound is returned when the plugin doesn't know the execution
+var errPluginNotFound = errors.New("not found on plugin")
+
+const (
+	// pluginRequestTimeout bounds every request made to a plugin
+	pluginRequestTimeout = 30 * time.Second
+
+	// pluginPollConcurrency is how many executions of a plugin are polled at
+	// the same time.
+	pluginPollConcurrency = 8
+)
+
+// pluginExecutor runs executions on an external executor speaking the HTTP
+// plugin protocol described in docs/plugin-protocol.md. Executions are
+// started with a request to the plugin, which then reports their status
+// through callbacks, answers status polls, or both.
+type pluginExecutor struct {
+	name   string
+	plugin config.Plugin
+
+	httpClient *http.Client
+
+	executionStorage storage.Storage[models.Execution]
+
+	opts Options
+
+	// watches holds the ids of the executions being polled
+	watchesMux sync.Mutex
+	watches    map[string]bool
+}
+
+func newPluginExecutor(name string, plugin config.Plugin, executionStorage storage.Storage[models.Execution], opts Options) *pluginExecutor {
+	return &pluginExecutor{
+		name:             name,
+		plugin:           plugin,
+		httpClient:       &http.Client{Timeout: pluginRequestTimeout},
+		executionStorage: executionStorage,
+		opts:             opts,
+		watches:          make(map[string]bool),
+	}
+}
+
+// pluginStartRequest asks the plugin to start an execution
+type pluginStartRequest struct {
+	ExecutionId string                `json:"execution_id"`
+	JobId       string                `json:"job_id"`
+	Manifest    *models.JobManifestV1 `json:"manifest"`
+	Deadline    *time.Time            `json:"deadline,omitempty"`
+	CallbackURL string                `json:"callback_url,omitempty"`
+}
+
+type pluginStartResponse struct {
+	InstanceId string `json:"instance_id"`
+}
+
+type pluginErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Start polls the running executions until ctx is done
+func (p *pluginExecutor) Start(ctx context.Context) error {
+	ticker := time.NewTicker(p.plugin.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		p.watchesMux.Lock()
+		ids := make([]string, 0, len(p.watches))
+		for id := range p.watches {
+			ids = append(ids, id)
+		}
+		p.watchesMux.Unlock()
+
+		eg, egCtx := errgroup.WithContext(ctx)
+		eg.SetLimit(pluginPollConcurrency)
+		for _, id := range ids {
+			eg.Go(func() error {
+				p.poll(egCtx, id)
+				return nil
+			})
+		}
+		_ = eg.Wait()
+	}
+}
+
+// reconcile resumes polling the executions the plugin was running
+func (p *pluginExecutor) reconcile(ctx context.Context) error {
+	for _, status := range []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING} {
+		executions, err := p.executionStorage.SearchBy(ctx, "Status", status)
+		if err != nil {
+			return err
+		}
+
+		for _, execution := range executions {
+			if execution.Executor != p.name {
+				continue
+			}
+
+			logger.Global.Info().Str("platform", p.name).Str("execution_id", execution.Id).Msg("resuming poll of running execution")
+			p.watch(execution.Id)
+		}
+	}
+
+	return nil
+}
+
+// Validate accepts every manifest, the plugin checks it when starting the
+// execution.
+func (p *pluginExecutor) Validate(manifest *models.JobManifestV1) error {
+	return nil
+}
+
+// run asks the plugin to start the execution of trigger and polls it
+func (p *pluginExecutor) run(ctx context.Context, trigger *models.Trigger) {
+	execution, err := loadExecution(ctx, p.executionStorage, trigger)
+	if err != nil {
+		logger.Global.Err(err).Str("execution_id", trigger.ExecutionId).Msg("couldn't load queued execution")
+		return
+	}
+
+	// Cancelled while waiting in the queue
+	if execution.Status == models.ExecutionStatus_CANCELLED {
+		logger.Global.Debug().Str("execution_id", execution.Id).Msg("execution cancelled before launch, skipping")
+		return
+	}
+
+	if _, err := p.update(ctx, execution, func(e *models.Execution) error {
+		e.Executor = p.name
+		return e.Transition(models.ExecutionStatus_CREATING, "")
+	}); err != nil {
+		logger.Global.Debug().Err(err).Str("execution_id", execution.Id).Msg("skipping execution update")
+		return
+	}
+
+	var deadline *time.Time
+	if timeout := trigger.Job.Manifest.TimeoutOr(p.opts.DefaultTimeout); timeout > 0 {
+		deadline = helpers.Ptr(time.Now().Add(timeout))
+	}
+
+	// The plugin gets the rendered manifest with the secret values, the
+	// stored one keeps the templates and references.
+	manifest, err := render(ctx, trigger.Job.Manifest, trigger.Job.Id, execution, p.opts.Secrets)
+	if err != nil {
+		_, _ = p.update(ctx, execution, func(e *models.Execution) error {
+			e.Error = err.Error()
+			return e.Transition(models.ExecutionStatus_ERRORED, err.Error())
+		})
+		return
+	}
+
+	req := &pluginStartRequest{
+		ExecutionId: execution.Id,
+		JobId:       trigger.Job.Id,
+		Manifest:    manifest,
+		Deadline:    deadline,
+		CallbackURL: p.callbackURL(execution.Id),
+	}
+
+	res := new(pluginStartResponse)
+	if err := p.do(ctx, http.MethodPost, p.endpoint("executions"), req, res); err != nil {
+		logger.Global.Err(err).Str("platform", p.name).Str("execution_id", execution.Id).Msg("couldn't launch execution")
+
+		_, _ = p.update(ctx, execution, func(e *models.Execution) error {
+			e.Error = err.Error()
+			return e.Transition(models.ExecutionStatus_ERRORED, err.Error())
+		})
+		return
+	}
+
+	execution, err = p.update(ctx, execution, func(e *models.Execution) error {
+		e.InstanceId = res.InstanceId
+		e.Deadline = deadline
+		return e.Transition(models.ExecutionStatus_RUNNING, "")
+	})
+	if err != nil {
+		// The execution could have been cancelled while the plugin was
+		// starting it, make sure it doesn't keep running.
+		if execution != nil && execution.Status == models.ExecutionStatus_CANCELLED {
+			if err := p.Cancel(ctx, execution); err != nil {
+				logger.Global.Err(err).Str("execution_id", execution.Id).Msg("couldn't stop cancelled execution")
+			}
+		}
+		return
+	}
+
+	if !execution.Status.Terminal() {
+		p.watch(execution.Id)
+	}
+}
+
+// Cancel stops polling the execution and asks the plugin to stop it.
+// Updating the execution status is left to the caller.
+func (p *pluginExecutor) Cancel(ctx context.Context, execution *models.Execution) error {
+	p.unwatch(execution.Id)
+
+	err := p.do(ctx, http.MethodDelete, p.endpoint("executions", execution.Id), nil, nil)
+	if errors.Is(err, errPluginNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// report applies a status report sent by the plugin through a callback
+func (p *pluginExecutor) report(ctx context.Context, execution *models.Execution, token string, report *models.ExecutionReport) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.plugin.Token)) != 1 {
+		return errors.Wrapf(models.ErrUnauthorizedReport, "invalid token for platform %s", p.name)
+	}
+
+	execution, err := p.update(ctx, execution, func(e *models.Execution) error {
+		return p.apply(e, report)
+	})
+	if err != nil {
+		return err
+	}
+
+	if execution.Status.Terminal() {
+		p.unwatch(execution.Id)
+	}
+
+	return nil
+}
+
+// poll asks the plugin for the status of an execution and applies it.
+// Executions past their deadline are timed out and stopped.
+func (p *pluginExecutor) poll(ctx context.Context, executionId string) {
+	execution, err := p.executionStorage.Get(ctx, executionId)
+	if err != nil {
+		logger.Global.Err(err).Str("execution_id", executionId).Msg("couldn't load polled execution")
+		return
+	}
+
+	if execution.Status.Terminal() {
+		p.unwatch(executionId)
+		return
+	}
+
+	u := p.endpoint("executions", executionId) + "?log_offset=" + strconv.Itoa(execution.LogsOffset)
+
+	report := new(models.ExecutionReport)
+	err = p.do(ctx, http.MethodGet, u, nil, report)
+	switch {
+	case errors.Is(err, errPluginNotFound):
+		report = &models.ExecutionReport{
+			Status:  models.ExecutionStatus_ERRORED,
+			Message: "execution unknown to plugin " + p.name,
+		}
+	case err != nil:
+		// The plugin could be restarting, try again on the next poll
+		logger.Global.Debug().Err(err).Str("execution_id", executionId).Msg("couldn't poll execution")
+		report = nil
+	}
+
+	if report != nil {
+		execution, err = p.update(ctx, execution, func(e *models.Execution) error {
+			return p.apply(e, report)
+		})
+		if err != nil {
+			logger.Global.Debug().Err(err).Str("execution_id", executionId).Msg("skipping execution update")
+			return
+		}
+	}
+
+	if execution.Status.Terminal() {
+		p.unwatch(executionId)
+		return
+	}
+
+	if execution.Deadline == nil || time.Now().Before(*execution.Deadline) {
+		return
+	}
+
+	logger.Global.Info().
+		Str("execution_id", executionId).
+		Time("deadline", *execution.Deadline).
+		Msg("execution timed out, stopping it")
+
+	if _, err := p.update(ctx, execution, func(e *models.Execution) error {
+		return e.Transition(models.ExecutionStatus_TIMED_OUT, "deadline exceeded")
+	}); err != nil {
+		return
+	}
+
+	if err := p.Cancel(ctx, execution); err != nil {
+		logger.Global.Err(err).Str("execution_id", executionId).Msg("couldn't stop timed out execution")
+	}
+}
+
+// apply updates the execution with a report of the plugin
+func (p *pluginExecutor) apply(execution *models.Execution, report *models.ExecutionReport) error {
+	switch report.Status {
+	case models.ExecutionStatus_RUNNING,
+		models.ExecutionStatus_SUCCEEDED,
+		models.ExecutionStatus_FAILED,
+		models.ExecutionStatus_ERRORED:
+	default:
+		return fmt.Errorf("%w: plugins can't report status %q", models.ErrInvalidReport, report.Status)
+	}
+
+	if execution.Status.Terminal() {
+		return fmt.Errorf("%w: execution already finished", models.ErrInvalidTransition)
+	}
+
+	logs := report.Logs
+	if report.LogOffset > 0 {
+		// Skip the lines a previous report already delivered
+		first := report.LogOffset - len(logs)
+		if skip := execution.LogsOffset - first; skip > 0 {
+			logs = logs[min(skip, len(logs)):]
+		}
+		execution.LogsOffset = max(execution.LogsOffset, report.LogOffset)
+	}
+	execution.AppendLogs(logs, p.opts.LogMaxLines, p.opts.LogMaxBytes)
+
+	if report.ExitCode != nil {
+		execution.ExitCode = report.ExitCode
+	}
+
+	// The plugin can report before the start request returned
+	if execution.Status == models.ExecutionStatus_CREATING {
+		if err := execution.Transition(models.ExecutionStatus_RUNNING, ""); err != nil {
+			return err
+		}
+	}
+
+	if report.Status == models.ExecutionStatus_ERRORED {
+		execution.Error = report.Message
+	}
+
+	return execution.Transition(report.Status, report.Message)
+}
+
+// update applies fn to the stored version of execution, the same execution
+// can be updated by its launch, a poll, a callback and a cancellation at
+// once.
+func (p *pluginExecutor) update(ctx context.Context, execution *models.Execution, fn func(*models.Execution) error) (*models.Execution, error) {
+	return updateExecution(ctx, p.executionStorage, execution, fn)
+}
+
+func (p *pluginExecutor) watch(executionId string) {
+	p.watchesMux.Lock()
+	defer p.watchesMux.Unlock()
+
+	p.watches[executionId] = true
+}
+
+func (p *pluginExecutor) unwatch(executionId string) {
+	p.watchesMux.Lock()
+	defer p.watchesMux.Unlock()
+
+	delete(p.watches, executionId)
+}
+
+// endpoint returns the plugin url for path
+func (p *pluginExecutor) endpoint(path ...string) string {
+	u, err := url.JoinPath(p.plugin.URL, path...)
+	if err != nil {
+		// The url is checked when loading the config
+		panic(err)
+	}
+
+	return u
+}
+
+// callbackURL returns where the plugin reports the status of an execution,
+// empty when the server has no public url.
+func (p *pluginExecutor) callbackURL(executionId string) string {
+	if p.opts.PublicURL == "" {
+		return ""
+	}
+
+	u, err := url.JoinPath(p.opts.PublicURL, "v0", "executions", executionId, "status")
+	if err != nil {
+		return ""
+	}
+
+	return u
+}
+
+// do sends a request to the plugin, encoding body and decoding the response
+// into out when they're set.
+func (p *pluginExecutor) do(ctx context.Context, method string, u string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+p.plugin.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "plugin %s", p.name)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errPluginNotFound
+	}
+
+	if res.StatusCode >= 300 {
+		errRes := new(pluginErrorResponse)
+		_ = json.NewDecoder(res.Body).Decode(errRes)
+
+		return fmt.Errorf("plugin %s: %s: %s", p.name, res.Status, errRes.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return errors.Wrapf(json.NewDecoder(res.Body).Decode(out), "plugin %s: couldn't decode response", p.name)
+}
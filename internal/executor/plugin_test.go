@@ -0,0 +1,422 @@
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jnfrati/boquita/internal/config"
+	"github.com/jnfrati/boquita/internal/helpers"
+	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/storage"
+)
+
+const testPluginToken = "plugin-token"
+
+// pluginRequest is a request received by a fake plugin
+type pluginRequest struct {
+	method        string
+	path          string
+	query         string
+	authorization string
+}
+
+// fakePlugin is a plugin server answering every request with status and
+// body, and recording the requests it got.
+type fakePlugin struct {
+	status int
+	body   any
+
+	mux      sync.Mutex
+	requests []pluginRequest
+}
+
+func (f *fakePlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := pluginRequest{
+		method:        r.Method,
+		path:          r.URL.Path,
+		query:         r.URL.RawQuery,
+		authorization: r.Header.Get("Authorization"),
+	}
+	f.mux.Lock()
+	f.requests = append(f.requests, req)
+	f.mux.Unlock()
+
+	status := f.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if f.body != nil {
+		_ = json.NewEncoder(w).Encode(f.body)
+	}
+}
+
+// received returns the requests received so far
+func (f *fakePlugin) received() []pluginRequest {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return slices.Clone(f.requests)
+}
+
+// methods returns the method and path of the received requests
+func (f *fakePlugin) methods() []string {
+	var methods []string
+	for _, req := range f.received() {
+		methods = append(methods, req.method+" "+req.path)
+	}
+
+	return methods
+}
+
+func newTestPlugin(t *testing.T, handler http.Handler, opts Options) (*pluginExecutor, storage.Storage[models.Execution]) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	executionStorage, err := storage.NewStorage[models.Execution](storage.StorageType_Memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := config.Plugin{URL: server.URL, Token: testPluginToken, PollInterval: time.Second}
+
+	return newPluginExecutor("fly", plugin, executionStorage, opts), executionStorage
+}
+
+// storeRunning stores a running execution of the plugin with the console
+// lines it already received.
+func storeRunning(t *testing.T, p *pluginExecutor, executionStorage storage.Storage[models.Execution], deadline *time.Time) *models.Execution {
+	t.Helper()
+
+	execution := models.NewExecution("exec", "job")
+	for _, next := range []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING} {
+		if err := execution.Transition(next, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	execution.Executor = p.name
+	execution.Logs = []string{"line 1", "line 2"}
+	execution.LogsOffset = 2
+	execution.Deadline = deadline
+
+	if err := executionStorage.Set(t.Context(), execution.Id, execution); err != nil {
+		t.Fatal(err)
+	}
+	p.watch(execution.Id)
+
+	return execution
+}
+
+func (p *pluginExecutor) watched(executionId string) bool {
+	p.watchesMux.Lock()
+	defer p.watchesMux.Unlock()
+
+	return p.watches[executionId]
+}
+
+func TestPluginRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		timeout   *string
+		status    int
+		body      any
+		expected  models.ExecutionStatus
+		error     string
+		callback  string
+		deadline  bool
+	}{
+		{
+			name:      "started",
+			publicURL: "https://boquita.example.com",
+			timeout:   helpers.Ptr("1h"),
+			body:      pluginStartResponse{InstanceId: "machine"},
+			expected:  models.ExecutionStatus_RUNNING,
+			callback:  "https://boquita.example.com/v0/executions/exec/status",
+			deadline:  true,
+		},
+		{
+			name:     "without public url",
+			body:     pluginStartResponse{InstanceId: "machine"},
+			expected: models.ExecutionStatus_RUNNING,
+		},
+		{
+			name:     "rejected",
+			status:   http.StatusUnprocessableEntity,
+			body:     pluginErrorResponse{Error: "image not found"},
+			expected: models.ExecutionStatus_ERRORED,
+			error:    "image not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mux     sync.Mutex
+				started *pluginStartRequest
+				auth    string
+			)
+			fake := &fakePlugin{status: tt.status, body: tt.body}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/executions" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+
+				req := new(pluginStartRequest)
+				if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+					t.Error(err)
+				}
+
+				mux.Lock()
+				started, auth = req, r.Header.Get("Authorization")
+				mux.Unlock()
+
+				fake.ServeHTTP(w, r)
+			})
+
+			p, executionStorage := newTestPlugin(t, handler, Options{PublicURL: tt.publicURL})
+
+			manifest := &models.JobManifestV1{Name: "job", Platform: helpers.Ptr("fly"), Timeout: tt.timeout}
+			p.run(t.Context(), &models.Trigger{ExecutionId: "exec", Job: &models.Job{Id: "job", Manifest: manifest}})
+
+			mux.Lock()
+			defer mux.Unlock()
+			if started == nil {
+				t.Fatal("expected the plugin to be asked to start the execution")
+			}
+			if started.ExecutionId != "exec" || started.JobId != "job" {
+				t.Fatalf("expected execution exec of job job, got %s of %s", started.ExecutionId, started.JobId)
+			}
+			if started.CallbackURL != tt.callback {
+				t.Fatalf("expected callback url %q, got %q", tt.callback, started.CallbackURL)
+			}
+			if (started.Deadline != nil) != tt.deadline {
+				t.Fatalf("expected deadline to be sent to be %t", tt.deadline)
+			}
+			if auth != "Bearer "+testPluginToken {
+				t.Fatalf("expected the plugin token, got %q", auth)
+			}
+
+			execution, err := executionStorage.Get(t.Context(), "exec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if execution.Status != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, execution.Status)
+			}
+			if execution.Executor != "fly" {
+				t.Fatalf("expected executor fly, got %s", execution.Executor)
+			}
+			if !strings.Contains(execution.Error, tt.error) {
+				t.Fatalf("expected error %q, got %q", tt.error, execution.Error)
+			}
+
+			running := tt.expected == models.ExecutionStatus_RUNNING
+			if running && execution.InstanceId != "machine" {
+				t.Fatalf("expected instance machine, got %q", execution.InstanceId)
+			}
+			if (execution.Deadline != nil) != tt.deadline {
+				t.Fatalf("expected deadline to be stored to be %t", tt.deadline)
+			}
+			if p.watched("exec") != running {
+				t.Fatalf("expected watched to be %t", running)
+			}
+		})
+	}
+}
+
+func TestPluginPoll(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		report   *models.ExecutionReport
+		deadline time.Duration
+		expected models.ExecutionStatus
+		logs     []string
+		requests []string
+		watched  bool
+	}{
+		{
+			name:     "running",
+			report:   &models.ExecutionReport{Status: models.ExecutionStatus_RUNNING, Logs: []string{"line 3"}, LogOffset: 3},
+			expected: models.ExecutionStatus_RUNNING,
+			logs:     []string{"line 1", "line 2", "line 3"},
+			requests: []string{"GET /executions/exec"},
+			watched:  true,
+		},
+		{
+			name:     "lines already received",
+			report:   &models.ExecutionReport{Status: models.ExecutionStatus_RUNNING, Logs: []string{"line 2", "line 3"}, LogOffset: 3},
+			expected: models.ExecutionStatus_RUNNING,
+			logs:     []string{"line 1", "line 2", "line 3"},
+			requests: []string{"GET /executions/exec"},
+			watched:  true,
+		},
+		{
+			name:     "succeeded",
+			report:   &models.ExecutionReport{Status: models.ExecutionStatus_SUCCEEDED, ExitCode: helpers.Ptr(uint(0))},
+			expected: models.ExecutionStatus_SUCCEEDED,
+			logs:     []string{"line 1", "line 2"},
+			requests: []string{"GET /executions/exec"},
+		},
+		{
+			name:     "unknown to the plugin",
+			status:   http.StatusNotFound,
+			expected: models.ExecutionStatus_ERRORED,
+			logs:     []string{"line 1", "line 2"},
+			requests: []string{"GET /executions/exec"},
+		},
+		{
+			name:     "plugin failing",
+			status:   http.StatusBadGateway,
+			expected: models.ExecutionStatus_RUNNING,
+			logs:     []string{"line 1", "line 2"},
+			requests: []string{"GET /executions/exec"},
+			watched:  true,
+		},
+		{
+			name:     "past its deadline",
+			report:   &models.ExecutionReport{Status: models.ExecutionStatus_RUNNING},
+			deadline: -time.Second,
+			expected: models.ExecutionStatus_TIMED_OUT,
+			logs:     []string{"line 1", "line 2"},
+			requests: []string{"GET /executions/exec", "DELETE /executions/exec"},
+		},
+		{
+			name:     "before its deadline",
+			report:   &models.ExecutionReport{Status: models.ExecutionStatus_RUNNING},
+			deadline: time.Hour,
+			expected: models.ExecutionStatus_RUNNING,
+			logs:     []string{"line 1", "line 2"},
+			requests: []string{"GET /executions/exec"},
+			watched:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakePlugin{status: tt.status}
+			if tt.report != nil {
+				fake.body = tt.report
+			}
+			p, executionStorage := newTestPlugin(t, fake, Options{})
+
+			var deadline *time.Time
+			if tt.deadline != 0 {
+				deadline = helpers.Ptr(time.Now().Add(tt.deadline))
+			}
+			storeRunning(t, p, executionStorage, deadline)
+
+			p.poll(t.Context(), "exec")
+
+			if requests := fake.methods(); !slices.Equal(requests, tt.requests) {
+				t.Fatalf("expected requests %v, got %v", tt.requests, requests)
+			}
+			if query := fake.received()[0].query; query != "log_offset=2" {
+				t.Fatalf("expected the received lines to be sent, got %q", query)
+			}
+
+			execution, err := executionStorage.Get(t.Context(), "exec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if execution.Status != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, execution.Status)
+			}
+			if !slices.Equal(execution.Logs, tt.logs) {
+				t.Fatalf("expected logs %v, got %v", tt.logs, execution.Logs)
+			}
+			if p.watched("exec") != tt.watched {
+				t.Fatalf("expected watched to be %t", tt.watched)
+			}
+		})
+	}
+}
+
+func TestPluginCancel(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    bool
+	}{
+		{name: "stopped", status: http.StatusNoContent},
+		{name: "unknown to the plugin", status: http.StatusNotFound},
+		{name: "plugin failing", status: http.StatusInternalServerError, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakePlugin{status: tt.status}
+			p, executionStorage := newTestPlugin(t, fake, Options{})
+			execution := storeRunning(t, p, executionStorage, nil)
+
+			err := p.Cancel(t.Context(), execution)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error to be %t, got %v", tt.err, err)
+			}
+
+			if requests := fake.methods(); !slices.Equal(requests, []string{"DELETE /executions/exec"}) {
+				t.Fatalf("expected the execution to be deleted, got %v", requests)
+			}
+			if auth := fake.received()[0].authorization; auth != "Bearer "+testPluginToken {
+				t.Fatalf("expected the plugin token, got %q", auth)
+			}
+			if p.watched("exec") {
+				t.Fatal("expected the execution to stop being polled")
+			}
+		})
+	}
+}
+
+func TestPluginReport(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "plugin token", token: testPluginToken},
+		{name: "no token", token: "", err: models.ErrUnauthorizedReport},
+		{name: "token prefix", token: testPluginToken[:len(testPluginToken)-1], err: models.ErrUnauthorizedReport},
+		{name: "longer token", token: testPluginToken + "-2", err: models.ErrUnauthorizedReport},
+		{name: "other token", token: "other-token", err: models.ErrUnauthorizedReport},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, executionStorage := newTestPlugin(t, &fakePlugin{}, Options{})
+			execution := storeRunning(t, p, executionStorage, nil)
+
+			report := &models.ExecutionReport{Status: models.ExecutionStatus_SUCCEEDED, Logs: []string{"line 3"}, LogOffset: 3}
+			if err := p.report(t.Context(), execution, tt.token, report); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			expected := models.ExecutionStatus_SUCCEEDED
+			if tt.err != nil {
+				expected = models.ExecutionStatus_RUNNING
+			}
+
+			stored, err := executionStorage.Get(t.Context(), "exec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != expected {
+				t.Fatalf("expected %s, got %s", expected, stored.Status)
+			}
+			if p.watched("exec") != (tt.err != nil) {
+				t.Fatalf("expected watched to be %t", tt.err != nil)
+			}
+		})
+	}
+}
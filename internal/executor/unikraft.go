@@ -0,0 +1,782 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	kraftcloud "sdk.kraft.cloud"
+	kcinstance "sdk.kraft.cloud/instances"
+	kcvolumes "sdk.kraft.cloud/volumes"
+
+	"github.com/jnfrati/boquita/internal/helpers"
+	"github.com/jnfrati/boquita/internal/logger"
+	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/storage"
+)
+
+// unikraftProfile is a client for one of the configured accounts. metros are
+// the failover metros of the account besides its default one.
+type unikraftProfile struct {
+	name   string
+	client kraftcloud.KraftCloud
+	metro  string
+	metros []string
+}
+
+// placement is a candidate account and metro to launch an instance on
+type placement struct {
+	profile *unikraftProfile
+	metro   string
+}
+
+type unikraftExecutor struct {
+	profiles       map[string]*unikraftProfile
+	defaultProfile string
+
+	executionStorage storage.Storage[models.Execution]
+
+	opts Options
+
+	// watches holds the running executions followed by the observer, keyed
+	// by execution id.
+	watchesMux sync.Mutex
+	watches    map[string]*watch
+}
+
+func newUnikraftExecutor(executionStorage storage.Storage[models.Execution], opts Options) (*unikraftExecutor, error) {
+	if len(opts.Unikraft.Profiles) == 0 {
+		return nil, errors.New("no unikraft profiles configured, can't start unikraft executor")
+	}
+
+	profiles := make(map[string]*unikraftProfile, len(opts.Unikraft.Profiles))
+	for name, p := range opts.Unikraft.Profiles {
+		logger.Global.Debug().Str("profile", name).Str("metro", p.Metro).Msg("configuring unikraft profile")
+
+		profiles[name] = &unikraftProfile{
+			name: name,
+			client: kraftcloud.NewClient(
+				kraftcloud.WithToken(p.Token),
+				kraftcloud.WithDefaultMetro(p.Metro),
+			),
+			metro:  p.Metro,
+			metros: p.Metros,
+		}
+	}
+
+	return &unikraftExecutor{
+		profiles:         profiles,
+		defaultProfile:   opts.Unikraft.DefaultProfile,
+		executionStorage: executionStorage,
+		opts:             opts,
+		watches:          make(map[string]*watch),
+	}, nil
+
+}
+
+// Start observes the running executions until ctx is done
+func (ue *unikraftExecutor) Start(ctx context.Context) error {
+	ue.runObserver(ctx)
+
+	return nil
+}
+
+// run launches the instance of a trigger and hands it to the observer
+func (ue *unikraftExecutor) run(ctx context.Context, trigger *models.Trigger) {
+	job := trigger.Job
+
+	logger.Global.Debug().Msgf("Received new job name %s ", job.Manifest.Name)
+
+	execution, err := loadExecution(ctx, ue.executionStorage, trigger)
+	if err != nil {
+		logger.Global.Err(err).Str("execution_id", trigger.ExecutionId).Msg("couldn't load queued execution")
+		return
+	}
+
+	// Cancelled while waiting in the queue
+	if execution.Status == models.ExecutionStatus_CANCELLED {
+		logger.Global.Debug().Str("execution_id", execution.Id).Msg("execution cancelled before launch, skipping")
+		return
+	}
+
+	if err := ue.update(ctx, execution, func(e *models.Execution) error {
+		e.Executor = models.DefaultPlatform
+		return e.Transition(models.ExecutionStatus_CREATING, "")
+	}); err != nil {
+		logger.Global.Debug().Err(err).Str("execution_id", execution.Id).Msg("skipping execution update")
+		return
+	}
+
+	// Hydrate the job manifest
+
+	manifest := job.Manifest
+
+	execId := execution.Id
+
+	err = ue.launch(ctx, execution, manifest)
+	if err != nil {
+		// A single failing image or platform hiccup must not stop the
+		// executor, the failure is recorded on the execution instead.
+		ue.markErrored(ctx, execution, err)
+		return
+	}
+
+	var deadline *time.Time
+	if timeout := manifest.TimeoutOr(ue.opts.DefaultTimeout); timeout > 0 {
+		deadline = helpers.Ptr(time.Now().Add(timeout))
+	}
+
+	if err := ue.update(ctx, execution, func(e *models.Execution) error {
+		e.Deadline = deadline
+		return e.Transition(models.ExecutionStatus_RUNNING, "")
+	}); err != nil {
+		// The execution was cancelled while the instance was being
+		// created, or can't be tracked: don't leave the instance behind.
+		logger.Global.Info().Err(err).Str("execution_id", execId).Msg("execution can't run anymore, removing its instance")
+		if err := ue.cleanup(ctx, execution); err != nil {
+			logger.Global.Err(err).Str("execution_id", execId).Msg("couldn't remove instance of cancelled execution")
+		}
+		return
+	}
+
+	logger.Global.Debug().Str("execution_id", execId).Str("instance_id", execution.InstanceId).Msg("Starting observable")
+	ue.observe(ctx, execution)
+}
+
+// Validate checks the profile and metros the manifest asks for can be used
+func (ue *unikraftExecutor) Validate(manifest *models.JobManifestV1) error {
+	_, err := ue.placements(manifest)
+	return err
+}
+
+// placements returns where the manifest can run, in order of preference.
+// The manifest profile, or the default one, is used on every allowed metro.
+// Without a profile, each allowed metro uses the first profile configured on
+// it, falling back to the default profile.
+func (ue *unikraftExecutor) placements(manifest *models.JobManifestV1) ([]placement, error) {
+	if manifest.Profile != nil {
+		profile, ok := ue.profiles[*manifest.Profile]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown profile %s", models.ErrInvalidManifest, *manifest.Profile)
+		}
+
+		if len(manifest.Metros) == 0 {
+			return []placement{{profile: profile, metro: profile.metro}}, nil
+		}
+
+		placements := make([]placement, 0, len(manifest.Metros))
+		for _, metro := range manifest.Metros {
+			placements = append(placements, placement{profile: profile, metro: metro})
+		}
+
+		return placements, nil
+	}
+
+	def := ue.profiles[ue.defaultProfile]
+	if len(manifest.Metros) == 0 {
+		return []placement{{profile: def, metro: def.metro}}, nil
+	}
+
+	names := make([]string, 0, len(ue.profiles))
+	for name := range ue.profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	placements := make([]placement, 0, len(manifest.Metros))
+	for _, metro := range manifest.Metros {
+		p := placement{profile: def, metro: metro}
+
+		if def.metro != metro {
+			for _, name := range names {
+				if ue.profiles[name].metro == metro {
+					p.profile = ue.profiles[name]
+					break
+				}
+			}
+		}
+
+		placements = append(placements, p)
+	}
+
+	return placements, nil
+}
+
+// launch creates the instance of the execution, trying every placement of the
+// manifest in order until one has capacity for it.
+func (ue *unikraftExecutor) launch(ctx context.Context, execution *models.Execution, manifest *models.JobManifestV1) error {
+	placements, err := ue.placements(manifest)
+	if err != nil {
+		return err
+	}
+
+	instanceName := instanceNamePrefix + manifest.Name + "-" + execution.Id
+
+	for i, p := range placements {
+		if err := ue.update(ctx, execution, func(e *models.Execution) error {
+			e.Profile = p.profile.name
+			e.Metro = p.metro
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		err = ue.createInstance(ctx, execution, manifest, instanceName)
+		if err == nil {
+			return nil
+		}
+
+		// Nothing should be left behind in a metro we're moving away from
+		ue.deleteVolumes(ctx, execution)
+
+		if !isCapacityError(err) || i == len(placements)-1 {
+			return err
+		}
+
+		logger.Global.Info().
+			Err(err).
+			Str("execution_id", execution.Id).
+			Str("profile", p.profile.name).
+			Str("metro", p.metro).
+			Msg("metro out of capacity, trying the next one")
+	}
+
+	return err
+}
+
+// createInstance creates the volumes and the instance of the execution on the
+// placement recorded on it.
+func (ue *unikraftExecutor) createInstance(ctx context.Context, execution *models.Execution, manifest *models.JobManifestV1, instanceName string) error {
+	// Secrets are only held for the time of the request, the manifest keeps
+	// the references.
+	rendered, err := render(ctx, manifest, execution.JobId, execution, ue.opts.Secrets)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := ue.createVolumes(ctx, execution, manifest)
+	if err != nil {
+		return err
+	}
+
+	logger.Global.Debug().
+		Str("profile", execution.Profile).
+		Str("metro", execution.Metro).
+		Msgf("Creating instance")
+	res, err := ue.instances(execution).Create(ctx, createRequest(instanceName, rendered, volumes))
+	if err != nil {
+		return err
+	}
+
+	if len(res.Errors) > 0 {
+		e := res.Errors[0]
+		return &platformError{op: "couldn't create instance", status: e.Status, code: int(e.Error), message: e.Message}
+	}
+
+	if len(res.Data.Entries) == 0 {
+		return errors.New("couldn't create instance, platform returned no instance")
+	}
+
+	// Recorded right away so a cancellation can remove the instance
+	instanceId := res.Data.Entries[0].UUID
+	return ue.update(ctx, execution, func(e *models.Execution) error {
+		e.InstanceId = instanceId
+		return nil
+	})
+}
+
+// platformError is an error entry of a platform response, code is the http
+// status the platform gave for it.
+type platformError struct {
+	op      string
+	status  string
+	code    int
+	message string
+}
+
+func (e *platformError) Error() string {
+	return fmt.Sprintf("%s, error status: %v (%d): %s", e.op, e.status, e.code, e.message)
+}
+
+// capacityCodes are the error codes the platform refuses to create something
+// with when the metro, or the account on it, is out of resources.
+var capacityCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusServiceUnavailable,
+	http.StatusInsufficientStorage,
+}
+
+// isCapacityError reports whether the platform refused to create something
+// because it's out of resources. Those are worth retrying somewhere else, any
+// other error would fail there too.
+func isCapacityError(err error) bool {
+	var perr *platformError
+	return errors.As(err, &perr) && slices.Contains(capacityCodes, perr.code)
+}
+
+// profile returns the profile an execution was placed with. Executions stored
+// before profiles existed use the default one.
+func (ue *unikraftExecutor) profile(execution *models.Execution) *unikraftProfile {
+	if p, ok := ue.profiles[execution.Profile]; ok {
+		return p
+	}
+
+	return ue.profiles[ue.defaultProfile]
+}
+
+// instances returns the instances client for the placement of the execution
+func (ue *unikraftExecutor) instances(execution *models.Execution) kcinstance.InstancesService {
+	p := ue.profile(execution)
+
+	metro := execution.Metro
+	if metro == "" {
+		metro = p.metro
+	}
+
+	return p.client.Instances().WithMetro(metro)
+}
+
+// volumes returns the volumes client for the placement of the execution
+func (ue *unikraftExecutor) volumes(execution *models.Execution) kcvolumes.VolumesService {
+	p := ue.profile(execution)
+
+	metro := execution.Metro
+	if metro == "" {
+		metro = p.metro
+	}
+
+	return p.client.Volumes().WithMetro(metro)
+}
+
+// markErrored records that the platform couldn't run the execution
+func (ue *unikraftExecutor) markErrored(ctx context.Context, execution *models.Execution, cause error) {
+	logger.Global.Err(cause).
+		Str("execution_id", execution.Id).
+		Str("job_id", execution.JobId).
+		Msg("couldn't launch execution")
+
+	if err := ue.update(ctx, execution, func(e *models.Execution) error {
+		e.Error = cause.Error()
+		return e.Transition(models.ExecutionStatus_ERRORED, cause.Error())
+	}); err != nil {
+		logger.Global.Debug().Err(err).Str("execution_id", execution.Id).Msg("skipping execution update")
+	}
+}
+
+// update applies fn to the stored version of execution and refreshes
+// execution with the result. It fails when fn does, e.g. because the
+// execution was cancelled in the meantime, execution then holds the stored
+// version.
+func (ue *unikraftExecutor) update(ctx context.Context, execution *models.Execution, fn func(*models.Execution) error) error {
+	stored, err := updateExecution(ctx, ue.executionStorage, execution, fn)
+	if stored != nil {
+		*execution = *stored
+	}
+
+	return err
+}
+
+// instanceNamePrefix marks the instances and volumes created by boquita, only
+// those are ever handled as orphans on startup.
+const instanceNamePrefix = "boquita-"
+
+// ownerTag is added to the tags of every instance created by boquita
+const ownerTag = "boquita"
+
+// executionIdFromInstance extracts the execution id from an instance name,
+// instances are named after the manifest name followed by the execution id.
+// owned reports whether the name carries the boquita prefix, instances
+// created before the prefix existed are only matched by their execution id.
+func executionIdFromInstance(name string) (execId string, owned bool, ok bool) {
+	if len(name) < 36 {
+		return "", false, false
+	}
+
+	execId = name[len(name)-36:]
+	if _, err := uuid.Parse(execId); err != nil {
+		return "", false, false
+	}
+
+	return execId, strings.HasPrefix(name, instanceNamePrefix), true
+}
+
+// reconcile picks up the instances left by a previous run of the executor.
+// Instances of stored running executions are observed again, the ones
+// without a known execution are handled according to the orphan policy, and
+// running executions whose instance is gone are marked as errored.
+func (ue *unikraftExecutor) reconcile(ctx context.Context) error {
+	active := make([]models.Execution, 0)
+	for _, status := range []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING} {
+		executions, err := ue.executionStorage.SearchBy(ctx, "Status", status)
+		if err != nil {
+			return err
+		}
+		for _, execution := range executions {
+			if execution.Executor == "" || execution.Executor == models.DefaultPlatform {
+				active = append(active, execution)
+			}
+		}
+	}
+
+	// Every profile metro is listed, failover ones included, plus the
+	// metros active executions were placed on.
+	locations := make(map[placement]bool)
+	for _, p := range ue.profiles {
+		locations[placement{profile: p, metro: p.metro}] = true
+		for _, metro := range p.metros {
+			locations[placement{profile: p, metro: metro}] = true
+		}
+	}
+	for _, execution := range active {
+		if execution.Metro != "" {
+			locations[placement{profile: ue.profile(&execution), metro: execution.Metro}] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	for location := range locations {
+		if err := ue.reconcileLocation(ctx, location, seen); err != nil {
+			return err
+		}
+	}
+
+	for _, execution := range active {
+		if seen[execution.Id] {
+			continue
+		}
+
+		logger.Global.Info().Str("execution_id", execution.Id).Msg("instance of running execution is gone, marking it as errored")
+		ue.markErrored(ctx, &execution, errors.New("instance disappeared while the executor was down"))
+	}
+
+	return nil
+}
+
+// reconcileLocation reconciles the instances of one profile and metro,
+// recording the execution ids it found in seen.
+func (ue *unikraftExecutor) reconcileLocation(ctx context.Context, location placement, seen map[string]bool) error {
+	instances := location.profile.client.Instances().WithMetro(location.metro)
+
+	res, err := instances.List(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list instances of profile %s on %s", location.profile.name, location.metro)
+	}
+
+	for _, instance := range res.Data.Entries {
+		execId, owned, ok := executionIdFromInstance(instance.Name)
+		if !ok || seen[execId] {
+			continue
+		}
+
+		execution, err := ue.executionStorage.Get(ctx, execId)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Instances that merely end with an uuid may belong to
+			// anyone on the account, never touch them.
+			if owned {
+				seen[execId] = true
+				ue.handleOrphan(ctx, location, execId, instance.UUID, instance.Name)
+			}
+			continue
+		}
+		seen[execId] = true
+		if err != nil {
+			return err
+		}
+
+		terminal := execution.Status.Terminal()
+		if err := ue.update(ctx, execution, func(e *models.Execution) error {
+			e.Profile = location.profile.name
+			e.Metro = location.metro
+			e.InstanceId = instance.UUID
+
+			if e.Status.Terminal() {
+				return nil
+			}
+			if e.Status == models.ExecutionStatus_QUEUED {
+				if err := e.Transition(models.ExecutionStatus_CREATING, "found running on restart"); err != nil {
+					return err
+				}
+			}
+			return e.Transition(models.ExecutionStatus_RUNNING, "resumed on restart")
+		}); err != nil {
+			logger.Global.Debug().Err(err).Str("execution_id", execId).Msg("skipping execution update")
+			continue
+		}
+
+		if terminal {
+			// The previous run stopped before removing the instance
+			logger.Global.Info().Str("execution_id", execId).Msg("removing instance of finished execution")
+			if err := ue.cleanup(ctx, execution); err != nil {
+				logger.Global.Err(err).Str("execution_id", execId).Msg("couldn't remove leftover instance")
+			}
+			continue
+		}
+
+		logger.Global.Info().Str("execution_id", execId).Msg("resuming observer of running execution")
+		ue.observe(ctx, execution)
+	}
+
+	return nil
+}
+
+func (ue *unikraftExecutor) handleOrphan(ctx context.Context, location placement, execId string, kinstanceId string, name string) {
+	log := logger.Global.Info().
+		Str("execution_id", execId).
+		Str("instance", name).
+		Str("profile", location.profile.name).
+		Str("metro", location.metro).
+		Str("policy", string(ue.opts.OrphanPolicy))
+
+	switch ue.opts.OrphanPolicy {
+	case OrphanPolicy_Delete:
+		log.Msg("removing unknown instance")
+		instances := location.profile.client.Instances().WithMetro(location.metro)
+		if err := deleteInstance(ctx, instances, kinstanceId); err != nil {
+			logger.Global.Err(err).Str("instance", name).Msg("couldn't remove unknown instance")
+		}
+	case OrphanPolicy_Adopt:
+		log.Msg("adopting unknown instance")
+		execution := models.NewExecution(execId, "")
+		if err := ue.update(ctx, execution, func(e *models.Execution) error {
+			e.Platform = models.DefaultPlatform
+			e.Executor = models.DefaultPlatform
+			e.InstanceId = kinstanceId
+			e.Profile = location.profile.name
+			e.Metro = location.metro
+
+			if err := e.Transition(models.ExecutionStatus_CREATING, "adopted"); err != nil {
+				return err
+			}
+			return e.Transition(models.ExecutionStatus_RUNNING, "adopted")
+		}); err != nil {
+			logger.Global.Err(err).Str("execution_id", execId).Msg("couldn't adopt instance")
+			return
+		}
+
+		ue.observe(ctx, execution)
+	default:
+		log.Msg("ignoring unknown instance")
+	}
+}
+
+// Cancel stops observing the execution and removes its instance. Updating the
+// execution status is left to the caller.
+func (ue *unikraftExecutor) Cancel(ctx context.Context, execution *models.Execution) error {
+	ue.unwatch(execution.Id)
+
+	if execution.InstanceId == "" {
+		return nil
+	}
+
+	return ue.cleanup(ctx, execution)
+}
+
+// logChunkSize is the amount of console output requested on each call
+const logChunkSize = 64 * 1024
+
+// collectLogs reads the console output produced since the last call and
+// appends it to the execution. Unless final is set, a trailing partial line is
+// left for the next call so lines aren't split in two.
+func (ue *unikraftExecutor) collectLogs(ctx context.Context, execution *models.Execution, kinstanceId string, final bool) error {
+	for {
+		res, err := ue.instances(execution).Log(ctx, kinstanceId, execution.LogsOffset, logChunkSize)
+		if err != nil {
+			return err
+		}
+
+		if len(res.Data.Entries) == 0 {
+			return nil
+		}
+
+		entry := res.Data.Entries[0]
+		if entry.Error != nil {
+			return fmt.Errorf("couldn't retrieve logs: %s", entry.Message)
+		}
+
+		output, err := base64.StdEncoding.DecodeString(entry.Output)
+		if err != nil {
+			return errors.Wrap(err, "couldn't decode instance logs")
+		}
+
+		if len(output) == 0 {
+			return nil
+		}
+
+		// A full chunk without any newline is a line longer than the chunk,
+		// or progress output overwriting itself: it's stored as a line of
+		// its own so collection doesn't stall until the instance exits.
+		consumed := len(output)
+		if newline := bytes.LastIndexByte(output, '\n'); !final && (newline >= 0 || len(output) < logChunkSize) {
+			consumed = newline + 1
+		}
+
+		if consumed == 0 {
+			return nil
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(output[:consumed]), "\n"), "\n")
+		if err := ue.update(ctx, execution, func(e *models.Execution) error {
+			e.AppendLogs(lines, ue.opts.LogMaxLines, ue.opts.LogMaxBytes)
+			e.LogsOffset += consumed
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if consumed < logChunkSize {
+			return nil
+		}
+	}
+}
+
+// createRequest maps the rendered manifest onto the instance create request
+func createRequest(instanceName string, manifest *models.JobManifestV1, volumes []kcinstance.CreateRequestVolume) kcinstance.CreateRequest {
+	req := kcinstance.CreateRequest{
+		Name:      &instanceName,
+		Image:     manifest.Image,
+		Args:      manifest.CommandLine(),
+		Env:       manifest.EnvMap,
+		MemoryMB:  manifest.MemoryMB,
+		Vcpus:     manifest.Vcpus,
+		Volumes:   volumes,
+		Tags:      append([]string{ownerTag}, manifest.Tags...),
+		Autostart: helpers.Ptr(true),
+	}
+
+	if manifest.RestartPolicy != nil {
+		req.RestartPolicy = helpers.Ptr(kcinstance.RestartPolicy(*manifest.RestartPolicy))
+	}
+
+	for _, f := range manifest.Features {
+		req.Features = append(req.Features, kcinstance.Feature(f))
+	}
+
+	return req
+}
+
+// createVolumes creates the ephemeral volumes of the manifest for this
+// execution and returns the volumes to attach to its instance. Created
+// volumes are recorded on the execution as soon as they exist so they can be
+// cleaned up even if a later step fails.
+func (ue *unikraftExecutor) createVolumes(ctx context.Context, execution *models.Execution, manifest *models.JobManifestV1) ([]kcinstance.CreateRequestVolume, error) {
+	volumes := make([]kcinstance.CreateRequestVolume, 0, len(manifest.Volumes))
+
+	for i, v := range manifest.Volumes {
+		volume := kcinstance.CreateRequestVolume{
+			UUID:     v.UUID,
+			Name:     v.Name,
+			At:       helpers.Ptr(v.At),
+			ReadOnly: helpers.Ptr(v.ReadOnly),
+		}
+
+		if v.Ephemeral {
+			name := fmt.Sprintf("%s%s-%s-%d", instanceNamePrefix, manifest.Name, execution.Id, i)
+
+			res, err := ue.volumes(execution).Create(ctx, name, *v.SizeMB)
+			if err == nil && len(res.Errors) > 0 {
+				e := res.Errors[0]
+				err = &platformError{op: "platform error", status: e.Status, code: int(e.Error), message: e.Message}
+			}
+			if err == nil && len(res.Data.Entries) == 0 {
+				err = errors.New("platform returned no volume")
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't create ephemeral volume for %s", v.At)
+			}
+
+			volumeId := res.Data.Entries[0].UUID
+			if err := ue.update(ctx, execution, func(e *models.Execution) error {
+				e.EphemeralVolumes = append(e.EphemeralVolumes, volumeId)
+				return nil
+			}); err != nil {
+				logger.Global.Err(err).Str("execution_id", execution.Id).Msg("couldn't store execution volumes")
+			}
+
+			volume.UUID = &volumeId
+		}
+
+		volumes = append(volumes, volume)
+	}
+
+	return volumes, nil
+}
+
+// cleanup removes everything the execution created on the platform: its
+// instance and then its ephemeral volumes.
+func (ue *unikraftExecutor) cleanup(ctx context.Context, execution *models.Execution) error {
+	if execution.InstanceId != "" {
+		if err := deleteInstance(ctx, ue.instances(execution), execution.InstanceId); err != nil {
+			return err
+		}
+	}
+
+	ue.deleteVolumes(ctx, execution)
+
+	return nil
+}
+
+// deleteVolumes removes the ephemeral volumes of the execution. Volumes can
+// stay attached for a moment after their instance is deleted, so deletion
+// is retried before giving up.
+func (ue *unikraftExecutor) deleteVolumes(ctx context.Context, execution *models.Execution) {
+	if len(execution.EphemeralVolumes) == 0 {
+		return
+	}
+
+	// Volumes that couldn't be removed stay recorded on the execution
+	var remaining []string
+	for _, volumeId := range execution.EphemeralVolumes {
+		retryCount := 0
+	retry:
+		_, err := ue.volumes(execution).Delete(ctx, volumeId)
+		if err != nil {
+			if retryCount > 3 {
+				logger.Global.Err(err).
+					Str("execution_id", execution.Id).
+					Str("volume", volumeId).
+					Msg("failed to delete ephemeral volume three times, leaving it behind")
+				remaining = append(remaining, volumeId)
+				continue
+			}
+
+			logger.Global.Debug().Err(err).Msg("failed to delete volume, retrying")
+			time.Sleep(2 * time.Second)
+			retryCount++
+			goto retry
+		}
+	}
+
+	if err := ue.update(ctx, execution, func(e *models.Execution) error {
+		e.EphemeralVolumes = remaining
+		return nil
+	}); err != nil {
+		logger.Global.Err(err).Str("execution_id", execution.Id).Msg("couldn't store execution volumes")
+	}
+}
+
+func deleteInstance(ctx context.Context, instances kcinstance.InstancesService, kinstanceId string) error {
+	retryCount := 0
+retry:
+	_, err := instances.Delete(ctx, kinstanceId)
+	if err != nil {
+		if retryCount > 3 {
+			logger.Global.Debug().Err(err).Msg("failed to delete instance three times, stopping observer")
+			return errors.Wrap(err, "Retried 3 times, closing observer with error")
+		}
+
+		logger.Global.Debug().Err(err).Msg("failed to delete instance, retrying")
+		time.Sleep(2 * time.Second)
+		retryCount++
+		goto retry
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcinstance "sdk.kraft.cloud/instances"
+
+	"github.com/jnfrati/boquita/internal/logger"
+	"github.com/jnfrati/boquita/internal/models"
+)
+
+const (
+	// observerTick is how often the observer looks for executions due for a
+	// status poll.
+	observerTick = time.Second
+
+	// observerBatchSize is the maximum amount of instances asked for in a
+	// single status request.
+	observerBatchSize = 50
+
+	// minPollInterval and maxPollInterval bound how often an execution is
+	// polled, whatever its expected duration.
+	minPollInterval = 2 * time.Second
+	maxPollInterval = time.Minute
+
+	// expectedDurationFallback is used to pace executions without a deadline
+	expectedDurationFallback = 10 * time.Minute
+
+	// maxPollFailures is how many polls in a row can fail before the
+	// execution is given up on.
+	maxPollFailures = 3
+)
+
+// watch is a running execution followed by the observer
+type watch struct {
+	execution *models.Execution
+
+	nextPoll time.Time
+	failures int
+}
+
+// observe adds a running execution to the observer, it's followed until its
+// instance stops or it's removed through Cancel.
+func (ue *unikraftExecutor) observe(ctx context.Context, execution *models.Execution) {
+	ue.watchesMux.Lock()
+	defer ue.watchesMux.Unlock()
+
+	ue.watches[execution.Id] = &watch{
+		execution: execution,
+		nextPoll:  time.Now().Add(minPollInterval),
+	}
+}
+
+func (ue *unikraftExecutor) unwatch(executionId string) {
+	ue.watchesMux.Lock()
+	defer ue.watchesMux.Unlock()
+
+	delete(ue.watches, executionId)
+}
+
+// pollInterval paces the polls of an execution on how long it's expected to
+// run: short jobs are checked often so they're reported as soon as they end,
+// long ones less often so they don't flood the API.
+func pollInterval(expected time.Duration) time.Duration {
+	return min(max(expected/20, minPollInterval), maxPollInterval)
+}
+
+// schedule sets when the watch is polled next, never past the execution
+// deadline so timeouts are enforced on time.
+func (ue *unikraftExecutor) schedule(w *watch, now time.Time) {
+	execution := w.execution
+
+	expected := expectedDurationFallback
+	if execution.Deadline != nil {
+		expected = execution.Deadline.Sub(execution.StartedAt)
+	} else if ue.opts.DefaultTimeout > 0 {
+		expected = ue.opts.DefaultTimeout
+	}
+
+	w.nextPoll = now.Add(pollInterval(expected))
+	if execution.Deadline != nil && execution.Deadline.After(now) && execution.Deadline.Before(w.nextPoll) {
+		w.nextPoll = *execution.Deadline
+	}
+}
+
+// runObserver polls the status of every watched execution. Executions due for
+// a poll are grouped by profile and metro, so a single request covers up to
+// observerBatchSize instances, and each status is then handed to its
+// execution.
+func (ue *unikraftExecutor) runObserver(ctx context.Context) {
+	logger.Global.Debug().Msg("starting observer")
+	defer logger.Global.Debug().Msg("closing observer")
+
+	ticker := time.NewTicker(observerTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for location, watches := range ue.dueWatches(time.Now()) {
+			for batch := range slices.Chunk(watches, observerBatchSize) {
+				ue.pollBatch(ctx, location, batch)
+			}
+		}
+	}
+}
+
+// dueWatches returns the watches whose next poll is due, by location
+func (ue *unikraftExecutor) dueWatches(now time.Time) map[placement][]*watch {
+	ue.watchesMux.Lock()
+	defer ue.watchesMux.Unlock()
+
+	due := make(map[placement][]*watch)
+	for _, w := range ue.watches {
+		if w.nextPoll.After(now) {
+			continue
+		}
+
+		profile := ue.profile(w.execution)
+		metro := w.execution.Metro
+		if metro == "" {
+			metro = profile.metro
+		}
+
+		location := placement{profile: profile, metro: metro}
+		due[location] = append(due[location], w)
+	}
+
+	return due
+}
+
+// pollBatch fetches the status of a batch of instances in a single request
+// and fans the results out to their executions.
+func (ue *unikraftExecutor) pollBatch(ctx context.Context, location placement, batch []*watch) {
+	ids := make([]string, 0, len(batch))
+	for _, w := range batch {
+		ids = append(ids, w.execution.InstanceId)
+	}
+
+	logger.Global.Debug().
+		Str("profile", location.profile.name).
+		Str("metro", location.metro).
+		Int("instances", len(ids)).
+		Msg("Getting instances")
+
+	res, err := location.profile.client.Instances().WithMetro(location.metro).Get(ctx, ids...)
+	if err != nil {
+		logger.Global.Debug().Err(err).Msg("failed to retrieve instances")
+		for _, w := range batch {
+			ue.pollFailed(ctx, w, err)
+		}
+		return
+	}
+
+	instances := make(map[string]kcinstance.GetResponseItem, len(res.Data.Entries))
+	for _, instance := range res.Data.Entries {
+		instances[instance.UUID] = instance
+	}
+
+	var wg sync.WaitGroup
+	for _, w := range batch {
+		instance, ok := instances[w.execution.InstanceId]
+		if !ok {
+			ue.pollFailed(ctx, w, errors.New("instance missing from the status response"))
+			continue
+		}
+
+		if instance.Error != nil {
+			ue.pollFailed(ctx, w, fmt.Errorf("retrieving instance failed: %s", instance.Message))
+			continue
+		}
+
+		w.failures = 0
+
+		// Handling an instance can mean reading its logs and removing it,
+		// don't make the rest of the batch wait on it.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ue.handleInstance(ctx, w, instance)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// pollFailed gives up on an execution once its status couldn't be read
+// maxPollFailures times in a row. Its instance is removed so it isn't left
+// running unobserved.
+func (ue *unikraftExecutor) pollFailed(ctx context.Context, w *watch, cause error) {
+	w.failures++
+	if w.failures <= maxPollFailures {
+		ue.watchesMux.Lock()
+		ue.schedule(w, time.Now())
+		ue.watchesMux.Unlock()
+		return
+	}
+
+	execution := w.execution
+	logger.Global.Err(cause).Str("execution_id", execution.Id).Msg("failed to observe job")
+
+	ue.unwatch(execution.Id)
+	ue.markErrored(ctx, execution, errors.Wrap(cause, "lost track of the instance"))
+
+	go func() {
+		if err := ue.cleanup(ctx, execution); err != nil {
+			logger.Global.Err(err).Str("execution_id", execution.Id).Msg("couldn't remove instance after observer failure")
+		}
+	}()
+}
+
+// handleInstance updates the execution with the status of its instance.
+// Once the instance stopped, or ran past the execution deadline, the
+// execution is finished and the instance removed.
+func (ue *unikraftExecutor) handleInstance(ctx context.Context, w *watch, instance kcinstance.GetResponseItem) {
+	execution := w.execution
+	stopped := instance.StoppedAt != ""
+
+	logger.Global.
+		Debug().
+		Str("execution_id", execution.Id).
+		Str("instance_id", instance.UUID).
+		Str("status", string(execution.Status)).
+		Str("instance_state", string(instance.State)).
+		Msg("Got instance from unikraft")
+
+	// Pull the console output on every poll so the logs are available while
+	// the job runs, once stopped this drains whatever is left.
+	if err := ue.collectLogs(ctx, execution, instance.UUID, stopped); err != nil {
+		logger.Global.Debug().Err(err).Str("execution_id", execution.Id).Msg("couldn't collect instance logs")
+	}
+
+	next, reason := models.ExecutionStatus_RUNNING, ""
+	switch {
+	case stopped && instance.ExitCode == nil:
+		next, reason = models.ExecutionStatus_FAILED, "instance stopped without an exit code"
+	case stopped && *instance.ExitCode > 0:
+		next, reason = models.ExecutionStatus_FAILED, fmt.Sprintf("exited with code %d", *instance.ExitCode)
+	case stopped:
+		next = models.ExecutionStatus_SUCCEEDED
+	case execution.Deadline != nil && time.Now().After(*execution.Deadline):
+		logger.Global.Info().
+			Str("execution_id", execution.Id).
+			Time("deadline", *execution.Deadline).
+			Msg("execution timed out, removing instance")
+
+		next, reason = models.ExecutionStatus_TIMED_OUT, "deadline exceeded"
+	}
+
+	if next == models.ExecutionStatus_RUNNING {
+		// Still running, the collected logs are already stored
+		ue.watchesMux.Lock()
+		ue.schedule(w, time.Now())
+		ue.watchesMux.Unlock()
+		return
+	}
+
+	ue.unwatch(execution.Id)
+
+	if err := ue.update(ctx, execution, func(e *models.Execution) error {
+		e.ExitCode = instance.ExitCode
+		return e.Transition(next, reason)
+	}); err != nil {
+		// Someone else finished the execution (e.g. it was cancelled), they
+		// own the instance cleanup.
+		logger.Global.Debug().Err(err).Str("execution_id", execution.Id).Msg("skipping execution update")
+		return
+	}
+
+	// Deleting the instance also stops it when it's still running, which is
+	// what we want for timed out executions. It retries on failure, don't
+	// hold the next poll of the other executions on it.
+	go func() {
+		if err := ue.cleanup(ctx, execution); err != nil {
+			logger.Global.Err(err).Str("execution_id", execution.Id).Msg("couldn't remove finished instance")
+		}
+	}()
+}
@@ -0,0 +1,208 @@
+package executor
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	kcinstance "sdk.kraft.cloud/instances"
+
+	"github.com/jnfrati/boquita/internal/models"
+)
+
+// setPtr points p at v converted to the type p points to, the SDK numeric
+// types differ between fields.
+func setPtr[T ~int | ~int32 | ~int64 | ~uint | ~uint32 | ~uint64](p **T, v int) {
+	converted := T(v)
+	*p = &converted
+}
+
+func TestPollInterval(t *testing.T) {
+	tests := []struct {
+		expected time.Duration
+		interval time.Duration
+	}{
+		{expected: 10 * time.Second, interval: minPollInterval},
+		{expected: 10 * time.Minute, interval: 30 * time.Second},
+		{expected: 10 * time.Hour, interval: maxPollInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected.String(), func(t *testing.T) {
+			if interval := pollInterval(tt.expected); interval != tt.interval {
+				t.Fatalf("expected %s, got %s", tt.interval, interval)
+			}
+		})
+	}
+}
+
+func TestScheduleWatch(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name           string
+		started        time.Duration
+		deadline       *time.Time
+		defaultTimeout time.Duration
+		next           time.Time
+	}{
+		{name: "no deadline", next: now.Add(pollInterval(expectedDurationFallback))},
+		{name: "default timeout", defaultTimeout: time.Hour, next: now.Add(maxPollInterval)},
+		{name: "deadline paces polls", deadline: at(10 * time.Minute), next: now.Add(30 * time.Second)},
+		{name: "deadline before the next poll", started: -time.Hour, deadline: at(5 * time.Second), next: now.Add(5 * time.Second)},
+		{name: "deadline passed", started: -time.Hour, deadline: at(-time.Second), next: now.Add(maxPollInterval)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ue, _ := newTestExecutor(t, &fakeCloud{})
+			ue.opts.DefaultTimeout = tt.defaultTimeout
+
+			execution := models.NewExecution("exec", "job")
+			execution.StartedAt = now.Add(tt.started)
+			execution.Deadline = tt.deadline
+
+			w := &watch{execution: execution}
+			ue.schedule(w, now)
+
+			if !w.nextPoll.Equal(tt.next) {
+				t.Fatalf("expected the next poll at %s, got %s", tt.next, w.nextPoll)
+			}
+		})
+	}
+}
+
+func TestPollBatch(t *testing.T) {
+	running := kcinstance.GetResponseItem{UUID: "instance", State: "running"}
+
+	stopped := func(code *int) kcinstance.GetResponseItem {
+		instance := kcinstance.GetResponseItem{UUID: "instance", State: "stopped", StoppedAt: "2025-03-01T12:00:00Z"}
+		if code != nil {
+			setPtr(&instance.ExitCode, *code)
+		}
+		return instance
+	}
+	zero, two := 0, 2
+
+	tests := []struct {
+		name     string
+		statuses map[string]kcinstance.GetResponseItem
+		getErr   error
+		deadline time.Duration
+		failures int
+		status   models.ExecutionStatus
+		watched  bool
+		deleted  bool
+	}{
+		{
+			name:     "running",
+			statuses: map[string]kcinstance.GetResponseItem{"instance": running},
+			status:   models.ExecutionStatus_RUNNING,
+			watched:  true,
+		},
+		{
+			name:     "succeeded",
+			statuses: map[string]kcinstance.GetResponseItem{"instance": stopped(&zero)},
+			status:   models.ExecutionStatus_SUCCEEDED,
+			deleted:  true,
+		},
+		{
+			name:     "failed",
+			statuses: map[string]kcinstance.GetResponseItem{"instance": stopped(&two)},
+			status:   models.ExecutionStatus_FAILED,
+			deleted:  true,
+		},
+		{
+			name:     "stopped without exit code",
+			statuses: map[string]kcinstance.GetResponseItem{"instance": stopped(nil)},
+			status:   models.ExecutionStatus_FAILED,
+			deleted:  true,
+		},
+		{
+			name:     "past its deadline",
+			statuses: map[string]kcinstance.GetResponseItem{"instance": running},
+			deadline: -time.Second,
+			status:   models.ExecutionStatus_TIMED_OUT,
+			deleted:  true,
+		},
+		{
+			name:    "missing from the response",
+			status:  models.ExecutionStatus_RUNNING,
+			watched: true,
+		},
+		{
+			name:    "request failed",
+			getErr:  errors.New("unavailable"),
+			status:  models.ExecutionStatus_RUNNING,
+			watched: true,
+		},
+		{
+			name:     "missing too many times",
+			failures: maxPollFailures,
+			status:   models.ExecutionStatus_ERRORED,
+			deleted:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			cloud := &fakeCloud{statuses: tt.statuses, getErr: tt.getErr}
+			ue, executionStorage := newTestExecutor(t, cloud)
+
+			execution := models.NewExecution("exec", "job")
+			for _, next := range []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING} {
+				if err := execution.Transition(next, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			execution.InstanceId = "instance"
+			if tt.deadline != 0 {
+				deadline := time.Now().Add(tt.deadline)
+				execution.Deadline = &deadline
+			}
+			if err := executionStorage.Set(ctx, execution.Id, execution); err != nil {
+				t.Fatal(err)
+			}
+
+			ue.observe(ctx, execution)
+			w := ue.watches[execution.Id]
+			w.failures = tt.failures
+
+			ue.pollBatch(ctx, placement{profile: ue.profiles["default"], metro: "fra0"}, []*watch{w})
+
+			expected := 0
+			if tt.deleted {
+				expected = 1
+			}
+			if deleted := cloud.deletedInstances(expected); !slices.Equal(deleted, []string{"instance"}[:expected]) {
+				t.Fatalf("expected %d instances deleted, got %v", expected, deleted)
+			}
+
+			stored, err := executionStorage.Get(ctx, execution.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.status {
+				t.Fatalf("expected %s, got %s", tt.status, stored.Status)
+			}
+
+			ue.watchesMux.Lock()
+			_, watched := ue.watches[execution.Id]
+			ue.watchesMux.Unlock()
+			if watched != tt.watched {
+				t.Fatalf("expected watched to be %t, got %t", tt.watched, watched)
+			}
+
+			if tt.watched && !w.nextPoll.After(time.Now()) {
+				t.Fatal("expected the next poll to be scheduled")
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+package executor
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kraftcloud "sdk.kraft.cloud"
+	kcclient "sdk.kraft.cloud/client"
+	kcinstance "sdk.kraft.cloud/instances"
+
+	"github.com/jnfrati/boquita/internal/helpers"
+	"github.com/jnfrati/boquita/internal/models"
+	"github.com/jnfrati/boquita/internal/storage"
+)
+
+// fakeCloud is a kraftcloud client whose instance creation answers with the
+// error code configured for each metro, or succeeds when there's none.
+// console is the output of every instance, statuses what Get returns for each
+// instance id and getErr fails Get requests when set. listed are the
+// instances of each metro.
+type fakeCloud struct {
+	kraftcloud.KraftCloud
+
+	codes    map[string]int
+	console  []byte
+	statuses map[string]kcinstance.GetResponseItem
+	getErr   error
+	listed   map[string][]kcinstance.ListResponseItem
+
+	// mux guards the calls recorded, cleanups happen in the background
+	mux     sync.Mutex
+	created []string
+	deleted []string
+}
+
+// deletedInstances returns the instances deleted so far, waiting up to a
+// few seconds for count of them since cleanups run in the background.
+func (c *fakeCloud) deletedInstances(count int) []string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.mux.Lock()
+		done := len(c.deleted) >= count
+		c.mux.Unlock()
+
+		if done {
+			break
+		}
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return slices.Clone(c.deleted)
+}
+
+// newTestExecutor returns a unikraft executor with a single profile on fra0
+// using cloud, and the storage its executions are kept in.
+func newTestExecutor(t *testing.T, cloud *fakeCloud) (*unikraftExecutor, storage.Storage[models.Execution]) {
+	t.Helper()
+
+	executionStorage, err := storage.NewStorage[models.Execution](storage.StorageType_Memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &unikraftExecutor{
+		profiles:         map[string]*unikraftProfile{"default": {name: "default", client: cloud, metro: "fra0"}},
+		defaultProfile:   "default",
+		executionStorage: executionStorage,
+		watches:          make(map[string]*watch),
+	}, executionStorage
+}
+
+func (c *fakeCloud) Instances() kcinstance.InstancesService {
+	return &fakeInstances{cloud: c}
+}
+
+type fakeInstances struct {
+	kcinstance.InstancesService
+
+	cloud *fakeCloud
+	metro string
+}
+
+func (i *fakeInstances) WithMetro(metro string) kcinstance.InstancesService {
+	return &fakeInstances{cloud: i.cloud, metro: metro}
+}
+
+func (i *fakeInstances) Create(ctx context.Context, req kcinstance.CreateRequest) (*kcclient.ServiceResponse[kcinstance.CreateResponseItem], error) {
+	res := new(kcclient.ServiceResponse[kcinstance.CreateResponseItem])
+
+	if code, ok := i.cloud.codes[i.metro]; ok {
+		res.Errors = append(res.Errors, kcclient.APIResponseError{
+			Status:  "error",
+			Message: http.StatusText(code),
+			Error:   code,
+		})
+		return res, nil
+	}
+
+	i.cloud.mux.Lock()
+	i.cloud.created = append(i.cloud.created, i.metro)
+	i.cloud.mux.Unlock()
+
+	res.Data.Entries = append(res.Data.Entries, kcinstance.CreateResponseItem{UUID: "instance-" + i.metro})
+
+	return res, nil
+}
+
+func (i *fakeInstances) Get(ctx context.Context, ids ...string) (*kcclient.ServiceResponse[kcinstance.GetResponseItem], error) {
+	if i.cloud.getErr != nil {
+		return nil, i.cloud.getErr
+	}
+
+	res := new(kcclient.ServiceResponse[kcinstance.GetResponseItem])
+	for _, id := range ids {
+		if status, ok := i.cloud.statuses[id]; ok {
+			res.Data.Entries = append(res.Data.Entries, status)
+		}
+	}
+
+	return res, nil
+}
+
+func (i *fakeInstances) List(ctx context.Context) (*kcclient.ServiceResponse[kcinstance.ListResponseItem], error) {
+	res := new(kcclient.ServiceResponse[kcinstance.ListResponseItem])
+	res.Data.Entries = i.cloud.listed[i.metro]
+
+	return res, nil
+}
+
+func (i *fakeInstances) Delete(ctx context.Context, ids ...string) (*kcclient.ServiceResponse[kcinstance.DeleteResponseItem], error) {
+	i.cloud.mux.Lock()
+	defer i.cloud.mux.Unlock()
+
+	i.cloud.deleted = append(i.cloud.deleted, ids...)
+
+	res := new(kcclient.ServiceResponse[kcinstance.DeleteResponseItem])
+	for _, id := range ids {
+		res.Data.Entries = append(res.Data.Entries, kcinstance.DeleteResponseItem{UUID: id})
+	}
+
+	return res, nil
+}
+
+func (i *fakeInstances) Log(ctx context.Context, id string, offset int, limit int) (*kcclient.ServiceResponse[kcinstance.LogResponseItem], error) {
+	console := i.cloud.console[min(offset, len(i.cloud.console)):]
+	console = console[:min(limit, len(console))]
+
+	res := new(kcclient.ServiceResponse[kcinstance.LogResponseItem])
+	res.Data.Entries = append(res.Data.Entries, kcinstance.LogResponseItem{
+		UUID:   id,
+		Output: base64.StdEncoding.EncodeToString(console),
+	})
+
+	return res, nil
+}
+
+func TestIsCapacityError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		capacity bool
+	}{
+		{name: "out of capacity", err: &platformError{code: http.StatusServiceUnavailable}, capacity: true},
+		{name: "out of quota", err: &platformError{code: http.StatusTooManyRequests}, capacity: true},
+		{name: "out of storage", err: fmt.Errorf("creating volume: %w", &platformError{code: http.StatusInsufficientStorage}), capacity: true},
+		{name: "bad request", err: &platformError{code: http.StatusBadRequest, message: "not enough memory requested"}},
+		{name: "other error", err: errors.New("insufficient capacity")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if capacity := isCapacityError(tt.err); capacity != tt.capacity {
+				t.Fatalf("expected capacity error to be %t, got %t", tt.capacity, capacity)
+			}
+		})
+	}
+}
+
+func TestLaunchPlacements(t *testing.T) {
+	tests := []struct {
+		name    string
+		codes   map[string]int
+		metro   string
+		created []string
+		err     bool
+	}{
+		{name: "first metro", metro: "fra0", created: []string{"fra0"}},
+		{
+			name:    "first metro out of capacity",
+			codes:   map[string]int{"fra0": http.StatusServiceUnavailable},
+			metro:   "was1",
+			created: []string{"was1"},
+		},
+		{
+			name:  "first metro refusing the request",
+			codes: map[string]int{"fra0": http.StatusBadRequest},
+			metro: "fra0",
+			err:   true,
+		},
+		{
+			name:  "every metro out of capacity",
+			codes: map[string]int{"fra0": http.StatusServiceUnavailable, "was1": http.StatusServiceUnavailable},
+			metro: "was1",
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			cloud := &fakeCloud{codes: tt.codes}
+			ue, executionStorage := newTestExecutor(t, cloud)
+
+			execution := models.NewExecution("exec", "job")
+			if err := executionStorage.Set(ctx, execution.Id, execution); err != nil {
+				t.Fatal(err)
+			}
+
+			manifest := &models.JobManifestV1{
+				Name:     "job",
+				Image:    "nginx:latest",
+				MemoryMB: helpers.Ptr(128),
+				Metros:   []string{"fra0", "was1"},
+			}
+
+			err := ue.launch(ctx, execution, manifest)
+			if tt.err != (err != nil) {
+				t.Fatalf("expected an error to be %t, got %v", tt.err, err)
+			}
+
+			if !slices.Equal(cloud.created, tt.created) {
+				t.Fatalf("expected instances created in %v, got %v", tt.created, cloud.created)
+			}
+
+			stored, err := executionStorage.Get(ctx, execution.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stored.Metro != tt.metro {
+				t.Fatalf("expected the execution to be placed in %s, got %s", tt.metro, stored.Metro)
+			}
+
+			if !tt.err && stored.InstanceId != "instance-"+tt.metro {
+				t.Fatalf("expected the instance id to be recorded, got %q", stored.InstanceId)
+			}
+		})
+	}
+}
+
+func TestCollectLogs(t *testing.T) {
+	long := strings.Repeat("x", logChunkSize+10)
+	progress := strings.Repeat("50%\r", logChunkSize/4+10)
+
+	tests := []struct {
+		name    string
+		console string
+		final   bool
+		logs    []string
+		offset  int
+	}{
+		{name: "complete lines", console: "a\nb\n", logs: []string{"a", "b"}, offset: 4},
+		{name: "partial line", console: "a\nb", logs: []string{"a"}, offset: 2},
+		{name: "partial line once final", console: "a\nb", final: true, logs: []string{"a", "b"}, offset: 3},
+		{name: "partial line only", console: "b"},
+		{name: "line longer than a chunk", console: long, logs: []string{long[:logChunkSize]}, offset: logChunkSize},
+		{name: "progress without newlines", console: progress, logs: []string{progress[:logChunkSize]}, offset: logChunkSize},
+		{name: "line longer than a chunk once final", console: long, final: true, logs: []string{long[:logChunkSize], long[logChunkSize:]}, offset: len(long)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			ue, executionStorage := newTestExecutor(t, &fakeCloud{console: []byte(tt.console)})
+
+			execution := models.NewExecution("exec", "job")
+			if err := executionStorage.Set(ctx, execution.Id, execution); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ue.collectLogs(ctx, execution, "instance", tt.final); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := executionStorage.Get(ctx, execution.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Lines are too long to be printed
+			if !slices.Equal(stored.Logs, tt.logs) {
+				t.Fatalf("expected %d lines, got %d", len(tt.logs), len(stored.Logs))
+			}
+
+			if stored.LogsOffset != tt.offset {
+				t.Fatalf("expected offset %d, got %d", tt.offset, stored.LogsOffset)
+			}
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	const (
+		known   = "0b7d9f3c-6a52-4a5e-9d0e-2f0b7c9e1a01"
+		unknown = "5c1e2a4b-8f3d-4b6a-a7c9-0d2e4f6a8b02"
+	)
+
+	instance := func(name string) kcinstance.ListResponseItem {
+		return kcinstance.ListResponseItem{UUID: "instance-" + name, Name: name}
+	}
+
+	tests := []struct {
+		name    string
+		policy  OrphanPolicy
+		metros  []string
+		stored  []models.ExecutionStatus
+		listed  map[string][]kcinstance.ListResponseItem
+		status  models.ExecutionStatus
+		watched bool
+		deleted []string
+	}{
+		{
+			name:    "running execution",
+			stored:  []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING},
+			listed:  map[string][]kcinstance.ListResponseItem{"fra0": {instance("boquita-job-" + known)}},
+			status:  models.ExecutionStatus_RUNNING,
+			watched: true,
+		},
+		{
+			name:    "creating execution",
+			stored:  []models.ExecutionStatus{models.ExecutionStatus_CREATING},
+			listed:  map[string][]kcinstance.ListResponseItem{"fra0": {instance("boquita-job-" + known)}},
+			status:  models.ExecutionStatus_RUNNING,
+			watched: true,
+		},
+		{
+			name:    "instance named before the prefix",
+			stored:  []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING},
+			listed:  map[string][]kcinstance.ListResponseItem{"fra0": {instance("job-" + known)}},
+			status:  models.ExecutionStatus_RUNNING,
+			watched: true,
+		},
+		{
+			name:    "finished execution",
+			stored:  []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING, models.ExecutionStatus_SUCCEEDED},
+			listed:  map[string][]kcinstance.ListResponseItem{"fra0": {instance("boquita-job-" + known)}},
+			status:  models.ExecutionStatus_SUCCEEDED,
+			deleted: []string{"instance-boquita-job-" + known},
+		},
+		{
+			name:   "instance gone",
+			stored: []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING},
+			status: models.ExecutionStatus_ERRORED,
+		},
+		{
+			name:   "orphan ignored",
+			policy: OrphanPolicy_Ignore,
+			listed: map[string][]kcinstance.ListResponseItem{"fra0": {instance("boquita-job-" + unknown)}},
+		},
+		{
+			name:    "orphan deleted",
+			policy:  OrphanPolicy_Delete,
+			listed:  map[string][]kcinstance.ListResponseItem{"fra0": {instance("boquita-job-" + unknown)}},
+			deleted: []string{"instance-boquita-job-" + unknown},
+		},
+		{
+			name:    "orphan in a failover metro",
+			policy:  OrphanPolicy_Delete,
+			metros:  []string{"was1"},
+			listed:  map[string][]kcinstance.ListResponseItem{"was1": {instance("boquita-job-" + unknown)}},
+			deleted: []string{"instance-boquita-job-" + unknown},
+		},
+		{
+			name:    "orphan adopted",
+			policy:  OrphanPolicy_Adopt,
+			listed:  map[string][]kcinstance.ListResponseItem{"fra0": {instance("boquita-job-" + unknown)}},
+			status:  models.ExecutionStatus_RUNNING,
+			watched: true,
+		},
+		{
+			name:   "instance of someone else",
+			policy: OrphanPolicy_Delete,
+			listed: map[string][]kcinstance.ListResponseItem{"fra0": {instance("api-" + unknown)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			cloud := &fakeCloud{listed: tt.listed}
+			ue, executionStorage := newTestExecutor(t, cloud)
+			ue.opts.OrphanPolicy = tt.policy
+			ue.profiles["default"].metros = tt.metros
+
+			// The execution checked is the stored one, or the adopted one
+			// when nothing is stored
+			id := unknown
+			if tt.stored != nil {
+				id = known
+
+				execution := models.NewExecution(known, "job")
+				execution.Executor = models.DefaultPlatform
+				for _, next := range tt.stored {
+					if err := execution.Transition(next, ""); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := executionStorage.Set(ctx, execution.Id, execution); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := ue.reconcile(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if deleted := cloud.deletedInstances(len(tt.deleted)); !slices.Equal(deleted, tt.deleted) {
+				t.Fatalf("expected instances %v deleted, got %v", tt.deleted, deleted)
+			}
+
+			stored, err := executionStorage.Get(ctx, id)
+			switch {
+			case tt.status == "" && !errors.Is(err, storage.ErrNotFound):
+				t.Fatalf("expected no execution to be recorded, got %v", err)
+			case tt.status != "" && err != nil:
+				t.Fatal(err)
+			case tt.status != "" && stored.Status != tt.status:
+				t.Fatalf("expected %s, got %s", tt.status, stored.Status)
+			}
+
+			if _, watched := ue.watches[id]; watched != tt.watched {
+				t.Fatalf("expected watched to be %t, got %t", tt.watched, watched)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package logger
 import (
 	"flag"
 	"os"
+	"testing"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -17,7 +18,11 @@ func init() {
 	debug := flag.Bool("debug", false, "sets log level to debug")
 	logOutput := flag.String("log-output", "stderr", "sets log output (stderr, stdout, file)")
 	logFile := flag.String("log-file", "", "sets log file path (if log-output is file)")
-	flag.Parse()
+	// Test binaries register their own flags after init, parsing here would
+	// reject them
+	if !testing.Testing() {
+		flag.Parse()
+	}
 
 	if *debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -0,0 +1,255 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+type ExecutionStatus string
+
+const (
+	// ExecutionStatus_QUEUED is waiting in the queue for an executor
+	ExecutionStatus_QUEUED ExecutionStatus = "QUEUED"
+	// ExecutionStatus_CREATING is being launched on the executor platform
+	ExecutionStatus_CREATING ExecutionStatus = "CREATING"
+	ExecutionStatus_RUNNING  ExecutionStatus = "RUNNING"
+
+	ExecutionStatus_SUCCEEDED ExecutionStatus = "SUCCEEDED"
+	// ExecutionStatus_FAILED ran and exited with a non zero exit code
+	ExecutionStatus_FAILED ExecutionStatus = "FAILED"
+	// ExecutionStatus_ERRORED couldn't run or be tracked by the platform
+	ExecutionStatus_ERRORED   ExecutionStatus = "ERRORED"
+	ExecutionStatus_TIMED_OUT ExecutionStatus = "TIMED_OUT"
+	ExecutionStatus_CANCELLED ExecutionStatus = "CANCELLED"
+	// ExecutionStatus_SKIPPED left the queue without being launched
+	ExecutionStatus_SKIPPED ExecutionStatus = "SKIPPED"
+)
+
+// executionTransitions lists the statuses every status can move to, terminal
+// statuses can't move anywhere.
+var executionTransitions = map[ExecutionStatus][]ExecutionStatus{
+	ExecutionStatus_QUEUED: {
+		ExecutionStatus_CREATING,
+		ExecutionStatus_ERRORED,
+		ExecutionStatus_CANCELLED,
+		ExecutionStatus_SKIPPED,
+	},
+	ExecutionStatus_CREATING: {
+		ExecutionStatus_RUNNING,
+		ExecutionStatus_ERRORED,
+		ExecutionStatus_CANCELLED,
+	},
+	ExecutionStatus_RUNNING: {
+		ExecutionStatus_SUCCEEDED,
+		ExecutionStatus_FAILED,
+		ExecutionStatus_ERRORED,
+		ExecutionStatus_TIMED_OUT,
+		ExecutionStatus_CANCELLED,
+	},
+}
+
+// Terminal reports whether an execution in this status is done and won't be
+// updated anymore.
+func (s ExecutionStatus) Terminal() bool {
+	_, ok := executionTransitions[s]
+	return !ok
+}
+
+// CanTransition reports whether an execution can move from s to next.
+func (s ExecutionStatus) CanTransition(next ExecutionStatus) bool {
+	return slices.Contains(executionTransitions[s], next)
+}
+
+var ErrInvalidTransition = errors.New("invalid execution status transition")
+
+// ExecutionTransition records a status change of an execution
+type ExecutionTransition struct {
+	From   ExecutionStatus `json:"from,omitempty"`
+	To     ExecutionStatus `json:"to"`
+	At     time.Time       `json:"at"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+type TriggerKind string
+
+const (
+	// TriggerKind_SCHEDULE executions are enqueued by the job schedule
+	TriggerKind_SCHEDULE TriggerKind = "SCHEDULE"
+	// TriggerKind_MANUAL executions are asked for through the API
+	TriggerKind_MANUAL TriggerKind = "MANUAL"
+	// TriggerKind_CATCH_UP executions make up for schedule times missed
+	// while the server was down or the job paused
+	TriggerKind_CATCH_UP TriggerKind = "CATCH_UP"
+)
+
+type Execution struct {
+	Id string `json:"id"`
+
+	JobId string `json:"job_id"`
+
+	// Platform is the platform the job asked for, and Executor the one of
+	// its executors the execution was routed to.
+	Platform string `json:"platform,omitempty"`
+	Executor string `json:"executor,omitempty"`
+
+	// InstanceId identifies the instance running the execution on the
+	// executor platform, it's empty until the execution leaves the queue.
+	InstanceId string `json:"instance_id,omitempty"`
+
+	// Profile and Metro tell where the instance was placed
+	Profile string `json:"profile,omitempty"`
+	Metro   string `json:"metro,omitempty"`
+
+	// EphemeralVolumes are the ids of the volumes created for this
+	// execution, they're removed together with the instance.
+	EphemeralVolumes []string `json:"ephemeral_volumes,omitempty"`
+
+	// TriggerKind tells what enqueued the execution. Manual executions
+	// record who asked for them and the overrides applied to the manifest.
+	TriggerKind TriggerKind       `json:"trigger_kind"`
+	TriggeredBy string            `json:"triggered_by,omitempty"`
+	Overrides   *TriggerOverrides `json:"overrides,omitempty"`
+
+	// ScheduledAt is when the execution was meant to run, e.g. the cron
+	// tick that triggered it. Attempt counts its runs, starting at 1.
+	ScheduledAt time.Time `json:"scheduled_at"`
+	Attempt     int       `json:"attempt"`
+
+	// Jitter is how long after ScheduledAt the schedule enqueued the
+	// execution, to spread jobs sharing a schedule.
+	Jitter string `json:"jitter,omitempty"`
+
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Deadline is when a running execution times out, if ever.
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	Status ExecutionStatus `json:"status"`
+
+	// Transitions is the history of status changes, oldest first.
+	Transitions []ExecutionTransition `json:"transitions,omitempty"`
+
+	ExitCode *uint `json:"exit_code"`
+
+	// Error holds the reason the platform gave for not running the
+	// execution, set when it ends as errored.
+	Error string `json:"error,omitempty"`
+
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+	CancelledBy string     `json:"cancelled_by,omitempty"`
+
+	Logs []string `json:"logs"`
+
+	// LogsOffset is how much of the platform console output was already
+	// consumed into Logs: bytes for unikraft instances, lines for plugins.
+	LogsOffset int `json:"logs_offset,omitempty"`
+
+	// LogsDropped counts the lines removed from the head of Logs to keep it
+	// under the size caps.
+	LogsDropped int `json:"logs_dropped,omitempty"`
+}
+
+var (
+	// ErrInvalidReport is returned for reports that can't be applied to an
+	// execution.
+	ErrInvalidReport = errors.New("invalid execution report")
+	// ErrUnauthorizedReport is returned for reports that can't be
+	// authenticated as coming from the platform running the execution.
+	ErrUnauthorizedReport = errors.New("unauthorized execution report")
+)
+
+// ExecutionReport is the status of an execution as reported by an executor
+// plugin, either answering a status poll or through a callback.
+type ExecutionReport struct {
+	Status   ExecutionStatus `json:"status"`
+	ExitCode *uint           `json:"exit_code,omitempty"`
+	Message  string          `json:"message,omitempty"`
+
+	// Logs are console lines produced since the previous report. LogOffset
+	// is the amount of lines produced so far including these ones, it lets
+	// lines received both through a poll and a callback be kept only once.
+	Logs      []string `json:"logs,omitempty"`
+	LogOffset int      `json:"log_offset,omitempty"`
+}
+
+// NewExecution returns a queued execution of jobId, scheduled now
+func NewExecution(id string, jobId string) *Execution {
+	now := time.Now()
+
+	return &Execution{
+		Id:          id,
+		JobId:       jobId,
+		TriggerKind: TriggerKind_SCHEDULE,
+		ScheduledAt: now,
+		Attempt:     1,
+		QueuedAt:    now,
+		Status:      ExecutionStatus_QUEUED,
+		Transitions: []ExecutionTransition{
+			{To: ExecutionStatus_QUEUED, At: now},
+		},
+		Logs: []string{},
+	}
+}
+
+// Transition moves the execution to next, recording it in the transition
+// history and keeping the lifecycle timestamps up to date. Moving to the
+// current status is a no-op.
+func (e *Execution) Transition(next ExecutionStatus, reason string) error {
+	if e.Status == next {
+		return nil
+	}
+
+	if !e.Status.CanTransition(next) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, e.Status, next)
+	}
+
+	now := time.Now()
+	e.Transitions = append(e.Transitions, ExecutionTransition{
+		From:   e.Status,
+		To:     next,
+		At:     now,
+		Reason: reason,
+	})
+	e.Status = next
+
+	switch {
+	case next == ExecutionStatus_RUNNING:
+		e.StartedAt = now
+	case next.Terminal():
+		e.FinishedAt = &now
+	}
+
+	return nil
+}
+
+// AppendLogs adds lines to the execution logs, dropping the oldest lines when
+// maxLines or maxBytes are exceeded. A cap of zero disables it.
+func (e *Execution) AppendLogs(lines []string, maxLines int, maxBytes int) {
+	e.Logs = append(e.Logs, lines...)
+
+	drop := 0
+	if maxLines > 0 && len(e.Logs) > maxLines {
+		drop = len(e.Logs) - maxLines
+	}
+
+	if maxBytes > 0 {
+		size := 0
+		for _, l := range e.Logs[drop:] {
+			size += len(l)
+		}
+
+		for size > maxBytes && drop < len(e.Logs) {
+			size -= len(e.Logs[drop])
+			drop++
+		}
+	}
+
+	if drop > 0 {
+		e.Logs = slices.Clone(e.Logs[drop:])
+		e.LogsDropped += drop
+	}
+}
@@ -0,0 +1,141 @@
+package models_test
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jnfrati/boquita/internal/models"
+)
+
+func TestExecutionTransitions(t *testing.T) {
+	execution := models.NewExecution("exec", "job")
+
+	steps := []models.ExecutionStatus{
+		models.ExecutionStatus_CREATING,
+		models.ExecutionStatus_RUNNING,
+		models.ExecutionStatus_SUCCEEDED,
+	}
+	for _, status := range steps {
+		if err := execution.Transition(status, ""); err != nil {
+			t.Fatalf("transition to %s: %v", status, err)
+		}
+	}
+
+	if execution.FinishedAt == nil {
+		t.Fatal("expected finished_at to be set on a terminal status")
+	}
+	if execution.StartedAt.IsZero() {
+		t.Fatal("expected started_at to be set when running")
+	}
+
+	// QUEUED plus the three steps
+	if len(execution.Transitions) != 4 {
+		t.Fatalf("expected 4 transitions, got %d", len(execution.Transitions))
+	}
+
+	err := execution.Transition(models.ExecutionStatus_RUNNING, "")
+	if !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("expected leaving a terminal status to fail, got %v", err)
+	}
+}
+
+func TestExecutionInvalidTransition(t *testing.T) {
+	execution := models.NewExecution("exec", "job")
+
+	err := execution.Transition(models.ExecutionStatus_SUCCEEDED, "")
+	if !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("expected queued to succeeded to fail, got %v", err)
+	}
+
+	if execution.Status != models.ExecutionStatus_QUEUED {
+		t.Fatalf("status changed on an invalid transition: %s", execution.Status)
+	}
+}
+
+func TestExecutionAppendLogs(t *testing.T) {
+	long := strings.Repeat("x", 20)
+
+	tests := []struct {
+		name     string
+		batches  [][]string
+		maxLines int
+		maxBytes int
+		logs     []string
+		dropped  int
+	}{
+		{
+			name:    "no caps",
+			batches: [][]string{{"a", "b"}, {"c"}},
+			logs:    []string{"a", "b", "c"},
+		},
+		{
+			name:     "line cap",
+			batches:  [][]string{{"a", "b"}, {"c", "d", "e"}},
+			maxLines: 3,
+			logs:     []string{"c", "d", "e"},
+			dropped:  2,
+		},
+		{
+			name:     "line cap in a single batch",
+			batches:  [][]string{{"a", "b", "c", "d"}},
+			maxLines: 2,
+			logs:     []string{"c", "d"},
+			dropped:  2,
+		},
+		{
+			name:     "byte cap",
+			batches:  [][]string{{"aaaa", "bbbb"}, {"cccc"}},
+			maxBytes: 10,
+			logs:     []string{"bbbb", "cccc"},
+			dropped:  1,
+		},
+		{
+			name:     "both caps",
+			batches:  [][]string{{"a", "b", "cccc", "dddd"}},
+			maxLines: 3,
+			maxBytes: 8,
+			logs:     []string{"cccc", "dddd"},
+			dropped:  2,
+		},
+		{
+			name:     "single line over the byte cap",
+			batches:  [][]string{{"a"}, {long}},
+			maxBytes: 10,
+			logs:     []string{},
+			dropped:  2,
+		},
+		{
+			name:     "lines after a line over the byte cap",
+			batches:  [][]string{{long}, {"a", "b"}},
+			maxBytes: 10,
+			logs:     []string{"a", "b"},
+			dropped:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			execution := models.NewExecution("exec", "job")
+
+			appended := 0
+			for _, batch := range tt.batches {
+				execution.AppendLogs(batch, tt.maxLines, tt.maxBytes)
+				appended += len(batch)
+			}
+
+			if !slices.Equal(execution.Logs, tt.logs) {
+				t.Fatalf("expected logs %q, got %q", tt.logs, execution.Logs)
+			}
+
+			if execution.LogsDropped != tt.dropped {
+				t.Fatalf("expected %d dropped lines, got %d", tt.dropped, execution.LogsDropped)
+			}
+
+			if kept := len(execution.Logs) + execution.LogsDropped; kept != appended {
+				t.Fatalf("expected kept and dropped lines to add up to the %d appended, got %d", appended, kept)
+			}
+		})
+	}
+}
@@ -1,38 +1,32 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/robfig/cron/v3"
-)
-
-type ExecutionStatus uint8
 
-const (
-	ExecutionStatus_RUNNING ExecutionStatus = iota
-	ExecutionStatus_SUCCEEDED
-	ExecutionStatus_FAILED
+	"github.com/jnfrati/boquita/internal/secrets"
+	"github.com/jnfrati/boquita/internal/templating"
 )
 
-type Execution struct {
-	Id string `json:"id"`
-
-	JobId string `json:"job_id"`
-
-	StartedAt  time.Time  `json:"started_at"`
-	FinishedAt *time.Time `json:"finished_at,omitempty"`
-
-	Status ExecutionStatus `json:"status"`
+var ErrInvalidManifest = errors.New("invalid job manifest")
 
-	ExitCode *uint `json:"exit_code"`
-
-	Logs []string `json:"logs"`
-}
+// DefaultPlatform runs the jobs whose manifest doesn't select a platform
+const DefaultPlatform = "unikraft"
 
 type JobManifestVersion string
 
 const (
 	JobManifestVersion_v1 JobManifestVersion = "job.manifest/v1"
+	// JobManifestVersion_v1Schedule is a one-shot job, it runs a single time
+	// at Schedule, or as soon as it's created with RunNow.
+	JobManifestVersion_v1Schedule JobManifestVersion = "job.manifest/v1/schedule"
 )
 
 type JobManifestV1 struct {
@@ -41,18 +35,491 @@ type JobManifestV1 struct {
 	Image      string             `json:"image"`
 	Entrypoint string             `json:"entrypoint"`
 	MemoryMB   *int               `json:"memory_mb,omitempty"`
-	Args       []string           `json:"args,omitempty"`
-	EnvMap     map[string]string  `json:"env_map,omitempty"`
+	// Args, Command and EnvMap values are text/template templates expanded
+	// with the execution context when the instance is created, see
+	// templating.Context.
+	Args []string `json:"args,omitempty"`
+	// EnvMap values can reference secrets instead of holding them, e.g.
+	// secret://name/key, file:///path or env://VAR. References are resolved
+	// when the instance is created and their values are never stored. Only
+	// references written as is are resolved, never the result of a template.
+	EnvMap map[string]string `json:"env_map,omitempty"`
+
+	// Command replaces the whole command line of the image, it can't be
+	// combined with Entrypoint or Args.
+	Command []string `json:"command,omitempty"`
+
+	Vcpus         *int           `json:"vcpus,omitempty"`
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+	Features      []string       `json:"features,omitempty"`
+	Tags          []string       `json:"tags,omitempty"`
+
+	// Platform selects the executor that runs the job, either the built-in
+	// unikraft one or a configured plugin. DefaultPlatform is used when empty.
+	Platform *string `json:"platform,omitempty"`
+	// Selector restricts the executors of the platform the job can run on
+	// to the ones having all these labels.
+	Selector map[string]string `json:"selector,omitempty"`
+
+	// Profile selects the executor profile (account and metro) the job
+	// runs on, the server default is used when empty.
+	Profile *string `json:"profile,omitempty"`
+	// Metros lists the metros the job is allowed to run on, in order of
+	// preference. The next one is tried when a metro is out of capacity.
+	Metros []string `json:"metros,omitempty"`
+
+	// Timeout is the maximum time an execution is allowed to run, in
+	// time.ParseDuration format (e.g. "30m"). When empty the server default
+	// is used.
+	Timeout *string `json:"timeout,omitempty"`
 
-	Cron     *string `json:"cron_expr,omitempty"`
+	Cron *string `json:"cron_expr,omitempty"`
+
+	// Timezone is the tz database name cron_expr is evaluated in, e.g.
+	// America/Argentina/Buenos_Aires. The server local time is used when
+	// empty.
+	Timezone *string `json:"timezone,omitempty"`
+
+	// Jitter is the window the runs of cron_expr are delayed within, e.g.
+	// "5m", to spread jobs sharing a schedule. Every job gets a fixed offset
+	// in the window. Defaults to the server --default-jitter, "0" disables
+	// it. @every intervals are never jittered.
+	Jitter *string `json:"jitter,omitempty"`
+
+	// Schedule is when a one-shot job runs, in RFC3339 format. RunNow runs
+	// it as soon as it's created instead.
 	Schedule *string `json:"schedule,omitempty"`
-	// TODO: Support Volumes, maybe for this job manifest version using
-	// Volumes instances.CreateRequestVolume
+	RunNow   bool    `json:"run_now,omitempty"`
+
+	// CatchUp is what's run on startup for the schedule times missed while
+	// the server was down, StartingDeadline how late a missed run can still
+	// start, e.g. "2h". Missed runs are all skipped by default.
+	CatchUp          *CatchUpPolicy `json:"catch_up,omitempty"`
+	StartingDeadline *string        `json:"starting_deadline,omitempty"`
+
+	Volumes []VolumeV1 `json:"volumes,omitempty"`
+}
+
+type RestartPolicy string
+
+const (
+	RestartPolicy_Never     RestartPolicy = "never"
+	RestartPolicy_Always    RestartPolicy = "always"
+	RestartPolicy_OnFailure RestartPolicy = "on-failure"
+)
+
+type CatchUpPolicy string
+
+const (
+	// CatchUpPolicy_None skips every missed run
+	CatchUpPolicy_None CatchUpPolicy = "none"
+	// CatchUpPolicy_Latest runs the most recent missed run only
+	CatchUpPolicy_Latest CatchUpPolicy = "latest"
+	// CatchUpPolicy_All runs every missed run, oldest first
+	CatchUpPolicy_All CatchUpPolicy = "all"
+)
+
+// Feature_ScaleToZero can't be used by jobs: their instances aren't exposed
+// through a service, so nothing would ever wake them up.
+const Feature_ScaleToZero = "scale-to-zero"
+
+// PlatformName returns the platform the job runs on
+func (m *JobManifestV1) PlatformName() string {
+	if m.Platform == nil || *m.Platform == "" {
+		return DefaultPlatform
+	}
+
+	return *m.Platform
+}
+
+// SelectorMatches reports whether an executor with labels can run the job
+func (m *JobManifestV1) SelectorMatches(labels map[string]string) bool {
+	for k, v := range m.Selector {
+		if label, ok := labels[k]; !ok || label != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CommandLine returns the arguments the instance is started with
+func (m *JobManifestV1) CommandLine() []string {
+	if len(m.Command) > 0 {
+		return m.Command
+	}
+
+	if m.Entrypoint != "" {
+		return append([]string{m.Entrypoint}, m.Args...)
+	}
+
+	return m.Args
+}
+
+// TriggerOverrides change the manifest of a single manually triggered
+// execution.
+type TriggerOverrides struct {
+	// Args replace the manifest args when set
+	Args []string `json:"args,omitempty"`
+	// Env is merged onto the manifest env
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// WithOverrides returns a copy of the manifest with o applied, the manifest
+// itself is left untouched.
+func (m *JobManifestV1) WithOverrides(o *TriggerOverrides) *JobManifestV1 {
+	copied := *m
+	if o == nil {
+		return &copied
+	}
+
+	if o.Args != nil {
+		copied.Args = slices.Clone(o.Args)
+	}
+
+	if len(o.Env) > 0 {
+		copied.EnvMap = maps.Clone(m.EnvMap)
+		if copied.EnvMap == nil {
+			copied.EnvMap = make(map[string]string, len(o.Env))
+		}
+		maps.Copy(copied.EnvMap, o.Env)
+	}
+
+	return &copied
+}
+
+// VolumeV1 mounts a volume in the job instance. It either references an
+// existing volume by Name or UUID, or is Ephemeral: created for every
+// execution and removed together with its instance.
+type VolumeV1 struct {
+	Name *string `json:"name,omitempty"`
+	UUID *string `json:"uuid,omitempty"`
+
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	SizeMB    *int `json:"size_mb,omitempty"`
+
+	// At is the path the volume is mounted at
+	At       string `json:"at"`
+	ReadOnly bool   `json:"read_only,omitempty"`
 }
 
+func (v *VolumeV1) validate() error {
+	if !path.IsAbs(v.At) {
+		return errors.New("at must be an absolute path")
+	}
+
+	refs := 0
+	for _, set := range []bool{v.Name != nil, v.UUID != nil, v.Ephemeral} {
+		if set {
+			refs++
+		}
+	}
+	if refs != 1 {
+		return errors.New("exactly one of name, uuid or ephemeral must be set")
+	}
+
+	if v.Ephemeral && (v.SizeMB == nil || *v.SizeMB <= 0) {
+		return errors.New("ephemeral volumes need a positive size_mb")
+	}
+	if !v.Ephemeral && v.SizeMB != nil {
+		return errors.New("size_mb can only be set on ephemeral volumes")
+	}
+
+	return nil
+}
+
+// Validate checks the manifest fields that can't be expressed through the
+// json tags, so a broken manifest is rejected before it's ever scheduled.
+func (m *JobManifestV1) Validate() error {
+	if m.Timezone != nil {
+		if m.Cron == nil {
+			return fmt.Errorf("%w: timezone requires cron_expr", ErrInvalidManifest)
+		}
+		if _, err := time.LoadLocation(*m.Timezone); err != nil || *m.Timezone == "" {
+			return fmt.Errorf("%w: unknown timezone %q", ErrInvalidManifest, *m.Timezone)
+		}
+		if strings.HasPrefix(*m.Cron, "TZ=") || strings.HasPrefix(*m.Cron, "CRON_TZ=") {
+			return fmt.Errorf("%w: cron_expr can't have a timezone prefix when timezone is set", ErrInvalidManifest)
+		}
+	}
+
+	if m.OneShot() {
+		if m.Cron != nil {
+			return fmt.Errorf("%w: cron_expr can't be used by one-shot jobs", ErrInvalidManifest)
+		}
+		if (m.Schedule != nil) == m.RunNow {
+			return fmt.Errorf("%w: exactly one of schedule or run_now must be set", ErrInvalidManifest)
+		}
+		if m.Schedule != nil {
+			if _, err := time.Parse(time.RFC3339, *m.Schedule); err != nil {
+				return fmt.Errorf("%w: schedule: %w", ErrInvalidManifest, err)
+			}
+		}
+	} else if m.Schedule != nil || m.RunNow {
+		return fmt.Errorf("%w: schedule and run_now require version %s", ErrInvalidManifest, JobManifestVersion_v1Schedule)
+	}
+
+	if m.Timeout != nil {
+		timeout, err := time.ParseDuration(*m.Timeout)
+		if err != nil {
+			return fmt.Errorf("%w: timeout: %w", ErrInvalidManifest, err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("%w: timeout must be positive", ErrInvalidManifest)
+		}
+	}
+
+	if m.Jitter != nil {
+		if m.Cron == nil {
+			return fmt.Errorf("%w: jitter requires cron_expr", ErrInvalidManifest)
+		}
+		jitter, err := time.ParseDuration(*m.Jitter)
+		if err != nil {
+			return fmt.Errorf("%w: jitter: %w", ErrInvalidManifest, err)
+		}
+		if jitter < 0 {
+			return fmt.Errorf("%w: jitter can't be negative", ErrInvalidManifest)
+		}
+	}
+
+	if m.CatchUp != nil {
+		switch *m.CatchUp {
+		case CatchUpPolicy_None, CatchUpPolicy_Latest, CatchUpPolicy_All:
+		default:
+			return fmt.Errorf("%w: unknown catch_up %q", ErrInvalidManifest, *m.CatchUp)
+		}
+	}
+
+	if m.StartingDeadline != nil {
+		deadline, err := time.ParseDuration(*m.StartingDeadline)
+		if err != nil {
+			return fmt.Errorf("%w: starting_deadline: %w", ErrInvalidManifest, err)
+		}
+		if deadline <= 0 {
+			return fmt.Errorf("%w: starting_deadline must be positive", ErrInvalidManifest)
+		}
+	}
+
+	if len(m.Command) > 0 && (m.Entrypoint != "" || len(m.Args) > 0) {
+		return fmt.Errorf("%w: command can't be combined with entrypoint or args", ErrInvalidManifest)
+	}
+
+	if m.MemoryMB != nil && *m.MemoryMB <= 0 {
+		return fmt.Errorf("%w: memory_mb must be positive", ErrInvalidManifest)
+	}
+
+	if m.Vcpus != nil && *m.Vcpus <= 0 {
+		return fmt.Errorf("%w: vcpus must be positive", ErrInvalidManifest)
+	}
+
+	if m.RestartPolicy != nil {
+		switch *m.RestartPolicy {
+		case RestartPolicy_Never, RestartPolicy_OnFailure:
+		case RestartPolicy_Always:
+			// An instance that's always restarted never finishes, the
+			// timeout is the only thing that ends it.
+			if m.Timeout == nil {
+				return fmt.Errorf("%w: restart_policy always requires a timeout", ErrInvalidManifest)
+			}
+		default:
+			return fmt.Errorf("%w: unknown restart_policy %q", ErrInvalidManifest, *m.RestartPolicy)
+		}
+	}
+
+	features := make(map[string]bool)
+	for _, f := range m.Features {
+		if f == "" || features[f] {
+			return fmt.Errorf("%w: features must be unique and not empty", ErrInvalidManifest)
+		}
+		if f == Feature_ScaleToZero {
+			return fmt.Errorf("%w: feature %s isn't supported for jobs", ErrInvalidManifest, f)
+		}
+		features[f] = true
+	}
+
+	for _, t := range m.Tags {
+		if strings.TrimSpace(t) == "" {
+			return fmt.Errorf("%w: tags can't be empty", ErrInvalidManifest)
+		}
+	}
+
+	for _, metro := range m.Metros {
+		if strings.TrimSpace(metro) == "" {
+			return fmt.Errorf("%w: metros can't be empty", ErrInvalidManifest)
+		}
+	}
+
+	for k, v := range m.EnvMap {
+		if err := templating.Validate(v); err != nil {
+			return fmt.Errorf("%w: env_map %s: %w", ErrInvalidManifest, k, err)
+		}
+
+		if !secrets.IsReference(v) {
+			continue
+		}
+		// Templated values are never resolved, see EnvMap
+		if templating.IsTemplate(v) {
+			return fmt.Errorf("%w: env_map %s: secret references can't be templated", ErrInvalidManifest, k)
+		}
+		if _, err := secrets.ParseReference(v); err != nil {
+			return fmt.Errorf("%w: env_map %s: %w", ErrInvalidManifest, k, err)
+		}
+	}
+
+	for i, arg := range m.Args {
+		if err := templating.Validate(arg); err != nil {
+			return fmt.Errorf("%w: args[%d]: %w", ErrInvalidManifest, i, err)
+		}
+	}
+
+	for i, arg := range m.Command {
+		if err := templating.Validate(arg); err != nil {
+			return fmt.Errorf("%w: command[%d]: %w", ErrInvalidManifest, i, err)
+		}
+	}
+
+	for k := range m.Selector {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("%w: selector labels can't be empty", ErrInvalidManifest)
+		}
+	}
+
+	mounts := make(map[string]bool)
+	for i, v := range m.Volumes {
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("%w: volumes[%d]: %w", ErrInvalidManifest, i, err)
+		}
+
+		if mounts[v.At] {
+			return fmt.Errorf("%w: volumes[%d]: %s is already mounted", ErrInvalidManifest, i, v.At)
+		}
+		mounts[v.At] = true
+	}
+
+	return nil
+}
+
+// TimeoutOr returns the manifest timeout, or def when the manifest doesn't
+// set one. The manifest is expected to be validated already.
+func (m *JobManifestV1) TimeoutOr(def time.Duration) time.Duration {
+	if m.Timeout == nil {
+		return def
+	}
+
+	timeout, err := time.ParseDuration(*m.Timeout)
+	if err != nil {
+		return def
+	}
+
+	return timeout
+}
+
+// CatchUpPolicy returns the manifest catch up policy, CatchUpPolicy_None
+// when it isn't set.
+func (m *JobManifestV1) CatchUpPolicy() CatchUpPolicy {
+	if m.CatchUp == nil {
+		return CatchUpPolicy_None
+	}
+
+	return *m.CatchUp
+}
+
+// MissedRunDue reports whether a run missed at scheduledAt can still start
+// at now, according to the catch up policy and starting deadline.
+func (m *JobManifestV1) MissedRunDue(scheduledAt time.Time, now time.Time) bool {
+	if m.CatchUpPolicy() == CatchUpPolicy_None || scheduledAt.IsZero() {
+		return false
+	}
+
+	deadline := m.StartingDeadlineOr(0)
+	return deadline == 0 || now.Sub(scheduledAt) <= deadline
+}
+
+// StartingDeadlineOr returns the manifest starting deadline, or def when the
+// manifest doesn't set one.
+func (m *JobManifestV1) StartingDeadlineOr(def time.Duration) time.Duration {
+	if m.StartingDeadline == nil {
+		return def
+	}
+
+	deadline, err := time.ParseDuration(*m.StartingDeadline)
+	if err != nil {
+		return def
+	}
+
+	return deadline
+}
+
+// JitterOr returns the manifest jitter window, or def when the manifest
+// doesn't set one.
+func (m *JobManifestV1) JitterOr(def time.Duration) time.Duration {
+	if m.Jitter == nil {
+		return def
+	}
+
+	jitter, err := time.ParseDuration(*m.Jitter)
+	if err != nil {
+		return def
+	}
+
+	return jitter
+}
+
+// TimezoneName returns the timezone cron_expr is evaluated in, empty for the
+// server local time.
+func (m *JobManifestV1) TimezoneName() string {
+	if m.Timezone == nil {
+		return ""
+	}
+
+	return *m.Timezone
+}
+
+// OneShot reports whether the job runs a single time
+func (m *JobManifestV1) OneShot() bool {
+	return m.Version == JobManifestVersion_v1Schedule
+}
+
+// ScheduledAt returns when a one-shot job runs, the zero time for RunNow.
+// The manifest is expected to be validated already.
+func (m *JobManifestV1) ScheduledAt() time.Time {
+	if m.Schedule == nil {
+		return time.Time{}
+	}
+
+	t, _ := time.Parse(time.RFC3339, *m.Schedule)
+	return t
+}
+
+type JobState string
+
+const (
+	// JobState_ACTIVE jobs run on their schedule
+	JobState_ACTIVE JobState = "ACTIVE"
+	// JobState_COMPLETED one-shot jobs already ran, or missed their time
+	JobState_COMPLETED JobState = "COMPLETED"
+)
+
 type Job struct {
 	Id string `json:"id"`
 
+	State     JobState  `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// LastScheduledAt is the schedule time of the last execution enqueued
+	// by the schedule, missed runs are caught up from there on startup.
+	LastScheduledAt *time.Time `json:"last_scheduled_at,omitempty"`
+	// CompletedAt and CompletedReason tell when and why the job stopped
+	// being scheduled.
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	CompletedReason string     `json:"completed_reason,omitempty"`
+
+	// Paused jobs keep their definition but aren't scheduled until they're
+	// resumed.
+	Paused       bool       `json:"paused,omitempty"`
+	PausedReason string     `json:"paused_reason,omitempty"`
+	PausedAt     *time.Time `json:"paused_at,omitempty"`
+
 	LastExecution *Execution `json:"last_execution,omitempty"`
 
 	Executions []Execution `json:"executions,omitempty"`
@@ -60,6 +527,13 @@ type Job struct {
 	Manifest *JobManifestV1 `json:"manifest"`
 }
 
+// Trigger asks the executor to run a job, it's the item that goes through the
+// queue. The execution is stored as queued before the trigger is pushed.
+type Trigger struct {
+	ExecutionId string `json:"execution_id"`
+	Job         *Job   `json:"job"`
+}
+
 // Internal structure only
 type CronToJob struct {
 	JobId       string
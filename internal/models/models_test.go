@@ -0,0 +1,389 @@
+package models_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jnfrati/boquita/internal/helpers"
+	"github.com/jnfrati/boquita/internal/models"
+)
+
+func TestManifestValidate(t *testing.T) {
+	always := models.RestartPolicy_Always
+
+	tests := []struct {
+		name     string
+		manifest models.JobManifestV1
+		valid    bool
+	}{
+		{
+			name:     "entrypoint and args",
+			manifest: models.JobManifestV1{Entrypoint: "/server", Args: []string{"-v"}},
+			valid:    true,
+		},
+		{
+			name:     "command with args",
+			manifest: models.JobManifestV1{Command: []string{"/server"}, Args: []string{"-v"}},
+		},
+		{
+			name:     "restart always without timeout",
+			manifest: models.JobManifestV1{RestartPolicy: &always},
+		},
+		{
+			name:     "restart always with timeout",
+			manifest: models.JobManifestV1{RestartPolicy: &always, Timeout: helpers.Ptr("1h")},
+			valid:    true,
+		},
+		{
+			name:     "zero vcpus",
+			manifest: models.JobManifestV1{Vcpus: helpers.Ptr(0)},
+		},
+		{
+			name:     "scale to zero",
+			manifest: models.JobManifestV1{Features: []string{models.Feature_ScaleToZero}},
+		},
+		{
+			name: "ephemeral volume without size",
+			manifest: models.JobManifestV1{Volumes: []models.VolumeV1{
+				{Ephemeral: true, At: "/scratch"},
+			}},
+		},
+		{
+			name: "volume mounted twice",
+			manifest: models.JobManifestV1{Volumes: []models.VolumeV1{
+				{Name: helpers.Ptr("a"), At: "/data"},
+				{Ephemeral: true, SizeMB: helpers.Ptr(10), At: "/data"},
+			}},
+		},
+		{
+			name:     "secret references",
+			manifest: models.JobManifestV1{EnvMap: map[string]string{"A": "secret://db/password", "B": "env://TOKEN"}},
+			valid:    true,
+		},
+		{
+			name:     "templated args and env",
+			manifest: models.JobManifestV1{Args: []string{"--day={{ .ScheduledTime | date }}"}, EnvMap: map[string]string{"RUN": "{{ .ExecutionId }}"}},
+			valid:    true,
+		},
+		{
+			name:     "unknown template field",
+			manifest: models.JobManifestV1{Args: []string{"{{ .Window }}"}},
+		},
+		{
+			name:     "templated secret reference",
+			manifest: models.JobManifestV1{EnvMap: map[string]string{"A": "secret://{{ .JobName }}/password"}},
+		},
+		{
+			name:     "malformed secret reference",
+			manifest: models.JobManifestV1{EnvMap: map[string]string{"A": "secret://db"}},
+		},
+		{
+			name:     "cron with timezone",
+			manifest: models.JobManifestV1{Cron: helpers.Ptr("0 2 * * *"), Timezone: helpers.Ptr("America/Argentina/Buenos_Aires")},
+			valid:    true,
+		},
+		{
+			name:     "unknown timezone",
+			manifest: models.JobManifestV1{Cron: helpers.Ptr("0 2 * * *"), Timezone: helpers.Ptr("Mars/Olympus_Mons")},
+		},
+		{
+			name:     "timezone with a prefixed cron",
+			manifest: models.JobManifestV1{Cron: helpers.Ptr("CRON_TZ=UTC 0 2 * * *"), Timezone: helpers.Ptr("UTC")},
+		},
+		{
+			name:     "timezone without cron",
+			manifest: models.JobManifestV1{Timezone: helpers.Ptr("UTC")},
+		},
+		{
+			name:     "cron with jitter",
+			manifest: models.JobManifestV1{Cron: helpers.Ptr("0 * * * *"), Jitter: helpers.Ptr("5m")},
+			valid:    true,
+		},
+		{
+			name:     "negative jitter",
+			manifest: models.JobManifestV1{Cron: helpers.Ptr("0 * * * *"), Jitter: helpers.Ptr("-5m")},
+		},
+		{
+			name:     "jitter without cron",
+			manifest: models.JobManifestV1{Jitter: helpers.Ptr("5m")},
+		},
+		{
+			name:     "catch up with deadline",
+			manifest: models.JobManifestV1{CatchUp: helpers.Ptr(models.CatchUpPolicy_All), StartingDeadline: helpers.Ptr("2h")},
+			valid:    true,
+		},
+		{
+			name:     "unknown catch up",
+			manifest: models.JobManifestV1{CatchUp: helpers.Ptr(models.CatchUpPolicy("some"))},
+		},
+		{
+			name:     "negative starting deadline",
+			manifest: models.JobManifestV1{StartingDeadline: helpers.Ptr("-1h")},
+		},
+		{
+			name:     "one-shot at a time",
+			manifest: models.JobManifestV1{Version: models.JobManifestVersion_v1Schedule, Schedule: helpers.Ptr("2025-03-01T03:30:00Z")},
+			valid:    true,
+		},
+		{
+			name:     "one-shot run now",
+			manifest: models.JobManifestV1{Version: models.JobManifestVersion_v1Schedule, RunNow: true},
+			valid:    true,
+		},
+		{
+			name:     "one-shot without schedule",
+			manifest: models.JobManifestV1{Version: models.JobManifestVersion_v1Schedule},
+		},
+		{
+			name:     "one-shot with cron",
+			manifest: models.JobManifestV1{Version: models.JobManifestVersion_v1Schedule, RunNow: true, Cron: helpers.Ptr("* * * * *")},
+		},
+		{
+			name:     "one-shot with a cron schedule",
+			manifest: models.JobManifestV1{Version: models.JobManifestVersion_v1Schedule, Schedule: helpers.Ptr("0 3 * * *")},
+		},
+		{
+			name:     "schedule on a cron job",
+			manifest: models.JobManifestV1{Version: models.JobManifestVersion_v1, Schedule: helpers.Ptr("2025-03-01T03:30:00Z")},
+		},
+		{
+			name:     "timeout",
+			manifest: models.JobManifestV1{Timeout: helpers.Ptr("30m")},
+			valid:    true,
+		},
+		{
+			name:     "malformed timeout",
+			manifest: models.JobManifestV1{Timeout: helpers.Ptr("30 minutes")},
+		},
+		{
+			name:     "zero timeout",
+			manifest: models.JobManifestV1{Timeout: helpers.Ptr("0s")},
+		},
+		{
+			name:     "malformed jitter",
+			manifest: models.JobManifestV1{Cron: helpers.Ptr("0 * * * *"), Jitter: helpers.Ptr("soon")},
+		},
+		{
+			name:     "malformed starting deadline",
+			manifest: models.JobManifestV1{StartingDeadline: helpers.Ptr("2 hours")},
+		},
+		{
+			name:     "command",
+			manifest: models.JobManifestV1{Command: []string{"/server", "--day={{ .ScheduledTime | date }}"}},
+			valid:    true,
+		},
+		{
+			name:     "command with entrypoint",
+			manifest: models.JobManifestV1{Command: []string{"/server"}, Entrypoint: "/server"},
+		},
+		{
+			name:     "broken command template",
+			manifest: models.JobManifestV1{Command: []string{"{{ .JobId"}},
+		},
+		{
+			name:     "zero memory",
+			manifest: models.JobManifestV1{MemoryMB: helpers.Ptr(0)},
+		},
+		{
+			name:     "restart on failure",
+			manifest: models.JobManifestV1{RestartPolicy: helpers.Ptr(models.RestartPolicy_OnFailure)},
+			valid:    true,
+		},
+		{
+			name:     "unknown restart policy",
+			manifest: models.JobManifestV1{RestartPolicy: helpers.Ptr(models.RestartPolicy("sometimes"))},
+		},
+		{
+			name:     "duplicated feature",
+			manifest: models.JobManifestV1{Features: []string{"a", "a"}},
+		},
+		{
+			name:     "empty feature",
+			manifest: models.JobManifestV1{Features: []string{""}},
+		},
+		{
+			name:     "empty tag",
+			manifest: models.JobManifestV1{Tags: []string{"team", " "}},
+		},
+		{
+			name:     "metros",
+			manifest: models.JobManifestV1{Metros: []string{"fra0", "was1"}},
+			valid:    true,
+		},
+		{
+			name:     "empty metro",
+			manifest: models.JobManifestV1{Metros: []string{"fra0", ""}},
+		},
+		{
+			name:     "empty selector label",
+			manifest: models.JobManifestV1{Selector: map[string]string{"": "eu"}},
+		},
+		{
+			name: "volumes",
+			manifest: models.JobManifestV1{Volumes: []models.VolumeV1{
+				{Name: helpers.Ptr("a"), At: "/data", ReadOnly: true},
+				{UUID: helpers.Ptr("b"), At: "/state"},
+				{Ephemeral: true, SizeMB: helpers.Ptr(10), At: "/scratch"},
+			}},
+			valid: true,
+		},
+		{
+			name: "relative volume path",
+			manifest: models.JobManifestV1{Volumes: []models.VolumeV1{
+				{Name: helpers.Ptr("a"), At: "data"},
+			}},
+		},
+		{
+			name: "volume with name and uuid",
+			manifest: models.JobManifestV1{Volumes: []models.VolumeV1{
+				{Name: helpers.Ptr("a"), UUID: helpers.Ptr("b"), At: "/data"},
+			}},
+		},
+		{
+			name: "volume without reference",
+			manifest: models.JobManifestV1{Volumes: []models.VolumeV1{
+				{At: "/data"},
+			}},
+		},
+		{
+			name: "size of an existing volume",
+			manifest: models.JobManifestV1{Volumes: []models.VolumeV1{
+				{Name: helpers.Ptr("a"), SizeMB: helpers.Ptr(10), At: "/data"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.manifest.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("expected manifest to be valid, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, models.ErrInvalidManifest) {
+				t.Fatalf("expected an invalid manifest error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestManifestSelectorMatches(t *testing.T) {
+	manifest := models.JobManifestV1{Selector: map[string]string{"region": "eu"}}
+
+	if !manifest.SelectorMatches(map[string]string{"region": "eu", "gpu": "true"}) {
+		t.Fatal("expected executor with the selected labels to match")
+	}
+
+	if manifest.SelectorMatches(map[string]string{"region": "us"}) {
+		t.Fatal("expected executor with a different label value not to match")
+	}
+
+	if manifest.SelectorMatches(nil) {
+		t.Fatal("expected executor without labels not to match")
+	}
+
+	if !(&models.JobManifestV1{}).SelectorMatches(nil) {
+		t.Fatal("expected an empty selector to match every executor")
+	}
+}
+
+func TestManifestWithOverrides(t *testing.T) {
+	manifest := models.JobManifestV1{
+		Args:   []string{"--day=today"},
+		EnvMap: map[string]string{"A": "1", "B": "2"},
+	}
+
+	run := manifest.WithOverrides(&models.TriggerOverrides{
+		Args: []string{"--day=2025-03-01"},
+		Env:  map[string]string{"B": "3", "C": "4"},
+	})
+
+	if len(run.Args) != 1 || run.Args[0] != "--day=2025-03-01" {
+		t.Fatalf("expected args to be replaced, got %v", run.Args)
+	}
+
+	if run.EnvMap["A"] != "1" || run.EnvMap["B"] != "3" || run.EnvMap["C"] != "4" {
+		t.Fatalf("expected env to be merged, got %v", run.EnvMap)
+	}
+
+	if manifest.Args[0] != "--day=today" || manifest.EnvMap["B"] != "2" || len(manifest.EnvMap) != 2 {
+		t.Fatal("expected the original manifest to be left untouched")
+	}
+
+	if kept := manifest.WithOverrides(&models.TriggerOverrides{Env: map[string]string{"C": "4"}}); kept.Args[0] != "--day=today" {
+		t.Fatalf("expected args to be kept without an args override, got %v", kept.Args)
+	}
+}
+
+func TestManifestMissedRunDue(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		manifest models.JobManifestV1
+		missed   time.Time
+		due      bool
+	}{
+		{
+			name:     "no catch up",
+			manifest: models.JobManifestV1{},
+			missed:   now.Add(-time.Minute),
+		},
+		{
+			name:     "catch up without deadline",
+			manifest: models.JobManifestV1{CatchUp: helpers.Ptr(models.CatchUpPolicy_Latest)},
+			missed:   now.Add(-72 * time.Hour),
+			due:      true,
+		},
+		{
+			name:     "within deadline",
+			manifest: models.JobManifestV1{CatchUp: helpers.Ptr(models.CatchUpPolicy_All), StartingDeadline: helpers.Ptr("2h")},
+			missed:   now.Add(-time.Hour),
+			due:      true,
+		},
+		{
+			name:     "past deadline",
+			manifest: models.JobManifestV1{CatchUp: helpers.Ptr(models.CatchUpPolicy_All), StartingDeadline: helpers.Ptr("2h")},
+			missed:   now.Add(-3 * time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if due := tt.manifest.MissedRunDue(tt.missed, now); due != tt.due {
+				t.Fatalf("expected due to be %v, got %v", tt.due, due)
+			}
+		})
+	}
+}
+
+func TestManifestDurations(t *testing.T) {
+	def := 10 * time.Minute
+
+	tests := []struct {
+		name     string
+		value    *string
+		expected time.Duration
+	}{
+		{name: "unset", expected: def},
+		{name: "set", value: helpers.Ptr("90s"), expected: 90 * time.Second},
+		{name: "zero", value: helpers.Ptr("0"), expected: 0},
+		{name: "malformed", value: helpers.Ptr("soon"), expected: def},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := models.JobManifestV1{Timeout: tt.value, StartingDeadline: tt.value, Jitter: tt.value}
+
+			if timeout := manifest.TimeoutOr(def); timeout != tt.expected {
+				t.Fatalf("expected a %s timeout, got %s", tt.expected, timeout)
+			}
+			if deadline := manifest.StartingDeadlineOr(def); deadline != tt.expected {
+				t.Fatalf("expected a %s starting deadline, got %s", tt.expected, deadline)
+			}
+			if jitter := manifest.JitterOr(def); jitter != tt.expected {
+				t.Fatalf("expected a %s jitter, got %s", tt.expected, jitter)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// everyHour is the hour field of a spec running at every hour of the day
+const everyHour = 1<<24 - 1
+
+// ErrInvalidExpression is returned for cron expressions that can't be parsed
+var ErrInvalidExpression = errors.New("invalid cron expression")
+
+// ParserOptions are the syntax extensions accepted on top of the standard 5
+// fields cron expressions.
+type ParserOptions struct {
+	// Seconds accepts an optional leading seconds field, e.g. "*/30 * * * * *"
+	Seconds bool
+	// Descriptors accepts @hourly, @daily and the like, and intervals such as
+	// "@every 90s"
+	Descriptors bool
+}
+
+// Parser parses the cron expressions of jobs
+type Parser struct {
+	opts   ParserOptions
+	parser cron.Parser
+}
+
+func NewParser(opts ParserOptions) *Parser {
+	fields := cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow
+	if opts.Seconds {
+		fields |= cron.SecondOptional
+	}
+	if opts.Descriptors {
+		fields |= cron.Descriptor
+	}
+
+	return &Parser{
+		opts:   opts,
+		parser: cron.NewParser(fields),
+	}
+}
+
+// Parse parses expr, running it in the timezone named tz or in the server
+// local time when tz is empty. Around DST changes the schedule follows cron
+// semantics: runs due in the hour skipped when clocks go forward happen right
+// after the change, and runs in the hour repeated when clocks go back only
+// happen once. Expressions running at every hour aren't adjusted, they keep
+// running on elapsed time.
+func (p *Parser) Parse(expr string, tz string) (cron.Schedule, error) {
+	if tz != "" {
+		if strings.HasPrefix(expr, "TZ=") || strings.HasPrefix(expr, "CRON_TZ=") {
+			return nil, fmt.Errorf("%w: a timezone prefix can't be used together with a timezone", ErrInvalidExpression)
+		}
+
+		expr = "CRON_TZ=" + tz + " " + expr
+	}
+
+	s, err := p.parser.Parse(expr)
+	if err != nil {
+		return nil, p.explain(expr, err)
+	}
+
+	// Descriptors like @every run on elapsed time already
+	spec, ok := s.(*cron.SpecSchedule)
+	if !ok || spec.Hour&everyHour == everyHour {
+		return s, nil
+	}
+
+	return &dstSchedule{spec: spec}, nil
+}
+
+// explain turns a parser error into one naming the part of expr that's wrong
+func (p *Parser) explain(expr string, err error) error {
+	prefix := ""
+	if strings.HasPrefix(expr, "TZ=") || strings.HasPrefix(expr, "CRON_TZ=") {
+		tz, rest, _ := strings.Cut(expr, " ")
+		prefix, expr = tz+" ", strings.TrimSpace(rest)
+
+		_, name, _ := strings.Cut(tz, "=")
+		if _, err := time.LoadLocation(name); err != nil {
+			return fmt.Errorf("%w: unknown timezone %q", ErrInvalidExpression, name)
+		}
+	}
+
+	if strings.HasPrefix(expr, "@") {
+		if !p.opts.Descriptors {
+			return fmt.Errorf("%w: descriptors like %s aren't enabled", ErrInvalidExpression, strings.Fields(expr)[0])
+		}
+		return fmt.Errorf("%w: %w", ErrInvalidExpression, err)
+	}
+
+	fields := strings.Fields(expr)
+	names := []string{"minute", "hour", "day of month", "month", "day of week"}
+	switch {
+	case len(fields) == 6 && p.opts.Seconds:
+		names = append([]string{"second"}, names...)
+	case len(fields) != 5:
+		expected := "5"
+		if p.opts.Seconds {
+			expected = "5 or 6"
+		}
+		return fmt.Errorf("%w: expected %s fields, found %d", ErrInvalidExpression, expected, len(fields))
+	}
+
+	// Parse every field alone, the others replaced by wildcards, to find the
+	// first one that's wrong
+	for i, field := range fields {
+		alone := make([]string, len(fields))
+		for j := range alone {
+			alone[j] = "*"
+		}
+		alone[i] = field
+
+		if _, fieldErr := p.parser.Parse(prefix + strings.Join(alone, " ")); fieldErr != nil {
+			return fmt.Errorf("%w: %s field %q: %w", ErrInvalidExpression, names[i], field, fieldErr)
+		}
+	}
+
+	return fmt.Errorf("%w: %w", ErrInvalidExpression, err)
+}
+
+// dstSchedule wraps a cron spec to run the ticks skipped or repeated by DST
+// changes exactly once.
+type dstSchedule struct {
+	spec *cron.SpecSchedule
+}
+
+func (s *dstSchedule) Next(t time.Time) time.Time {
+	next := s.spec.Next(t)
+	for !next.IsZero() && repeated(next) {
+		next = s.spec.Next(next)
+	}
+
+	if skipped, ok := s.skipped(t, next); ok {
+		return skipped.In(t.Location())
+	}
+
+	return next
+}
+
+// skipped returns the first change between t and next where clocks went
+// forward over a time the spec should have run at.
+func (s *dstSchedule) skipped(t time.Time, next time.Time) (time.Time, bool) {
+	if next.IsZero() {
+		return time.Time{}, false
+	}
+
+	// The spec is evaluated on wall clocks, in UTC as it has no DST
+	wall := *s.spec
+	wall.Location = time.UTC
+
+	for change := zoneEnd(t.In(s.spec.Location)); !change.IsZero() && change.Before(next); change = zoneEnd(change) {
+		_, before := change.Add(-time.Second).Zone()
+		_, after := change.Zone()
+		if after <= before {
+			continue
+		}
+
+		// Wall clocks in [from, to) never happened
+		from := wallClock(change.Add(-time.Second)).Add(time.Second)
+		to := wallClock(change)
+
+		if due := wall.Next(from.Add(-time.Second)); due.Before(to) {
+			return change, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// zoneEnd returns when the zone in effect at t ends, the zero time if it
+// never does.
+func zoneEnd(t time.Time) time.Time {
+	_, end := t.ZoneBounds()
+	return end
+}
+
+// repeated reports whether the wall clock of t already happened earlier,
+// i.e. t is in the hour repeated when clocks went back.
+func repeated(t time.Time) bool {
+	start, _ := t.ZoneBounds()
+	if start.IsZero() {
+		return false
+	}
+
+	_, before := start.Add(-time.Second).Zone()
+	_, offset := t.Zone()
+
+	return before > offset && t.Sub(start) < time.Duration(before-offset)*time.Second
+}
+
+// wallClock returns the wall clock of t as a UTC time
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
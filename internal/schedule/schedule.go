@@ -0,0 +1,74 @@
+package schedule
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// once fires a single time, at a given instant
+type once struct {
+	at time.Time
+}
+
+// Once returns a cron.Schedule firing only at t. Once t is past, Next returns
+// the zero time, which the cron runner takes as never firing again.
+func Once(t time.Time) cron.Schedule {
+	return &once{at: t}
+}
+
+func (o *once) Next(now time.Time) time.Time {
+	if now.Before(o.at) {
+		return o.at
+	}
+
+	return time.Time{}
+}
+
+// Offset returns a deterministic offset in [0, window) derived from key,
+// truncated to the second. The same key always gets the same offset, so
+// spreading jobs by their id keeps their runs predictable.
+func Offset(key string, window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	return (time.Duration(h.Sum64() % uint64(window))).Truncate(time.Second)
+}
+
+// Interval reports whether s runs at a constant interval, e.g. "@every 1h",
+// instead of following wall clock ticks. Interval schedules start counting
+// when they're registered, so jobs sharing one aren't run at the same moment
+// and jittering them is pointless.
+func Interval(s cron.Schedule) bool {
+	_, ok := s.(cron.ConstantDelaySchedule)
+	return ok
+}
+
+// delayed runs every tick of a schedule offset later
+type delayed struct {
+	schedule cron.Schedule
+	offset   time.Duration
+}
+
+// Delay returns a cron.Schedule firing offset after every tick of s
+func Delay(s cron.Schedule, offset time.Duration) cron.Schedule {
+	if offset <= 0 {
+		return s
+	}
+
+	return &delayed{schedule: s, offset: offset}
+}
+
+func (d *delayed) Next(now time.Time) time.Time {
+	next := d.schedule.Next(now.Add(-d.offset))
+	if next.IsZero() {
+		return next
+	}
+
+	return next.Add(d.offset)
+}
@@ -0,0 +1,275 @@
+package schedule_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jnfrati/boquita/internal/schedule"
+)
+
+func TestOnce(t *testing.T) {
+	at := time.Date(2025, 3, 1, 3, 30, 0, 0, time.UTC)
+	s := schedule.Once(at)
+
+	if next := s.Next(at.Add(-time.Hour)); !next.Equal(at) {
+		t.Fatalf("expected to fire at %s, got %s", at, next)
+	}
+
+	if next := s.Next(at); !next.IsZero() {
+		t.Fatalf("expected to never fire again once run, got %s", next)
+	}
+
+	if next := s.Next(at.Add(time.Hour)); !next.IsZero() {
+		t.Fatalf("expected a past schedule to never fire, got %s", next)
+	}
+}
+
+func TestCronTimezone(t *testing.T) {
+	parser := schedule.NewParser(schedule.ParserOptions{})
+
+	s, err := parser.Parse("0 2 * * *", "America/Argentina/Buenos_Aires")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 02:00 in Buenos Aires is 05:00 UTC, wherever the server runs
+	next := s.Next(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC))
+	if expected := time.Date(2025, 3, 1, 5, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Fatalf("expected %s, got %s", expected, next.UTC())
+	}
+
+	if _, err := parser.Parse("0 2 * * *", "Mars/Olympus_Mons"); err == nil {
+		t.Fatal("expected an unknown timezone to be rejected")
+	}
+
+	if _, err := parser.Parse("CRON_TZ=UTC 0 2 * * *", "America/Argentina/Buenos_Aires"); err == nil {
+		t.Fatal("expected a timezone prefix to be rejected together with a timezone")
+	}
+}
+
+func TestCronDST(t *testing.T) {
+	parser := schedule.NewParser(schedule.ParserOptions{})
+	const tz = "America/New_York"
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expr     string
+		from     time.Time
+		expected []time.Time
+	}{
+		{
+			// 2025-03-09 02:00 EST jumps to 03:00 EDT, 02:30 never happens
+			name: "skipped hour runs after the change",
+			expr: "30 2 * * *",
+			from: time.Date(2025, 3, 8, 12, 0, 0, 0, loc),
+			expected: []time.Time{
+				time.Date(2025, 3, 9, 7, 0, 0, 0, time.UTC),
+				time.Date(2025, 3, 10, 6, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			// 2025-11-02 02:00 EDT goes back to 01:00 EST, 01:30 happens twice
+			name: "repeated hour runs once",
+			expr: "30 1 * * *",
+			from: time.Date(2025, 11, 1, 12, 0, 0, 0, loc),
+			expected: []time.Time{
+				time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC),
+				time.Date(2025, 11, 3, 6, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "every hour keeps running on elapsed time",
+			expr: "30 * * * *",
+			from: time.Date(2025, 11, 2, 0, 45, 0, 0, loc),
+			expected: []time.Time{
+				time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC),
+				time.Date(2025, 11, 2, 6, 30, 0, 0, time.UTC),
+				time.Date(2025, 11, 2, 7, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "outside of changes",
+			expr: "0 2 * * *",
+			from: time.Date(2025, 6, 1, 12, 0, 0, 0, loc),
+			expected: []time.Time{
+				time.Date(2025, 6, 2, 6, 0, 0, 0, time.UTC),
+				time.Date(2025, 6, 3, 6, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parser.Parse(tt.expr, tz)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			next := tt.from
+			for _, expected := range tt.expected {
+				next = s.Next(next)
+				if !next.Equal(expected) {
+					t.Fatalf("expected %s, got %s", expected, next.UTC())
+				}
+			}
+		})
+	}
+}
+
+func TestParserOptions(t *testing.T) {
+	from := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	standard := schedule.NewParser(schedule.ParserOptions{})
+	extended := schedule.NewParser(schedule.ParserOptions{Seconds: true, Descriptors: true})
+
+	tests := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{expr: "*/30 * * * * *", expected: from.Add(30 * time.Second)},
+		{expr: "0 * * * *", expected: from.Add(time.Hour)},
+		{expr: "@hourly", expected: from.Add(time.Hour)},
+		{expr: "@every 90s", expected: from.Add(90 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := extended.Parse(tt.expr, "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if next := s.Next(from); !next.Equal(tt.expected) {
+				t.Fatalf("expected %s, got %s", tt.expected, next)
+			}
+		})
+	}
+
+	for _, expr := range []string{"*/30 * * * * *", "@hourly", "@every 90s"} {
+		if _, err := standard.Parse(expr, ""); !errors.Is(err, schedule.ErrInvalidExpression) {
+			t.Fatalf("expected %q to be rejected by the standard parser, got %v", expr, err)
+		}
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	parser := schedule.NewParser(schedule.ParserOptions{Seconds: true, Descriptors: true})
+
+	tests := []struct {
+		expr     string
+		tz       string
+		contains string
+	}{
+		{expr: "0 25 * * *", contains: "hour field"},
+		{expr: "61 0 0 * * *", contains: "second field"},
+		{expr: "0 0 32 * *", contains: "day of month field"},
+		{expr: "0 0 * 13 *", contains: "month field"},
+		{expr: "0 0 * * mon-xyz", contains: "day of week field"},
+		{expr: "0 0 * *", contains: "expected 5 or 6 fields, found 4"},
+		{expr: "@every 90x", contains: "@every"},
+		{expr: "@sometimes", contains: "@sometimes"},
+		{expr: "0 25 * * *", tz: "America/Argentina/Buenos_Aires", contains: "hour field"},
+		{expr: "0 2 * * *", tz: "Mars/Olympus_Mons", contains: "unknown timezone"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parser.Parse(tt.expr, tt.tz)
+			if !errors.Is(err, schedule.ErrInvalidExpression) {
+				t.Fatalf("expected ErrInvalidExpression, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.contains) {
+				t.Fatalf("expected the error to mention %q, got %v", tt.contains, err)
+			}
+		})
+	}
+}
+
+func TestOffset(t *testing.T) {
+	window := 10 * time.Minute
+
+	a := schedule.Offset("job-a", window)
+	if a != schedule.Offset("job-a", window) {
+		t.Fatal("expected the offset of a key to be deterministic")
+	}
+
+	spread := map[time.Duration]bool{}
+	for _, key := range []string{"job-a", "job-b", "job-c", "job-d", "job-e"} {
+		offset := schedule.Offset(key, window)
+		if offset < 0 || offset >= window || offset != offset.Truncate(time.Second) {
+			t.Fatalf("expected a whole second offset in [0, %s), got %s", window, offset)
+		}
+		spread[offset] = true
+	}
+	if len(spread) < 2 {
+		t.Fatal("expected different keys to be spread over the window")
+	}
+
+	if offset := schedule.Offset("job-a", 0); offset != 0 {
+		t.Fatalf("expected no offset without a window, got %s", offset)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	parser := schedule.NewParser(schedule.ParserOptions{Descriptors: true})
+
+	tests := []struct {
+		expr     string
+		interval bool
+	}{
+		{expr: "0 * * * *"},
+		{expr: "30 3 * * *"},
+		{expr: "@hourly"},
+		{expr: "@every 90s", interval: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parser.Parse(tt.expr, "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if interval := schedule.Interval(s); interval != tt.interval {
+				t.Fatalf("expected interval to be %t, got %t", tt.interval, interval)
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	parser := schedule.NewParser(schedule.ParserOptions{})
+
+	hourly, err := parser.Parse("0 * * * *", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := schedule.Delay(hourly, 90*time.Second)
+	from := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	expected := []time.Time{
+		time.Date(2025, 3, 1, 0, 1, 30, 0, time.UTC),
+		time.Date(2025, 3, 1, 1, 1, 30, 0, time.UTC),
+	}
+
+	next := from
+	for _, e := range expected {
+		next = s.Next(next)
+		if !next.Equal(e) {
+			t.Fatalf("expected %s, got %s", e, next)
+		}
+	}
+
+	at := time.Date(2025, 3, 1, 3, 30, 0, 0, time.UTC)
+	if next := schedule.Delay(schedule.Once(at), time.Minute).Next(at); !next.Equal(at.Add(time.Minute)) {
+		t.Fatalf("expected a delayed tick to still fire once its time passed, got %s", next)
+	}
+}
@@ -0,0 +1,235 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileProvider reads secrets from a directory holding a directory per secret
+// and a file per key, the layout of mounted Kubernetes or Docker secrets:
+// secret://database/password reads <dir>/database/password.
+type FileProvider struct {
+	dir string
+}
+
+func NewFileProvider(dir string) *FileProvider {
+	return &FileProvider{dir: dir}
+}
+
+func (fp *FileProvider) Get(ctx context.Context, name string, key string) (string, error) {
+	for _, part := range []string{name, key} {
+		if part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+			return "", fmt.Errorf("%w: %s/%s", ErrInvalidReference, name, key)
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(fp.dir, name, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(content), "\n"), nil
+}
+
+// KeySize is the size of the key encrypting a Store, AES-256
+const KeySize = 32
+
+// Store is a local secret store encrypted with AES-GCM, it keeps every
+// secret in a single file that's rewritten on every change. The file is
+// loaded again when it changes, e.g. through `boquita secrets set` while a
+// server reads the same store.
+type Store struct {
+	path string
+	aead cipher.AEAD
+
+	mux     sync.Mutex
+	secrets map[string]map[string]string
+	// loaded is the modification time and size of the file last read or
+	// written
+	loaded os.FileInfo
+}
+
+// NewStore opens the store at path encrypted with key, the file is created
+// on the first write if it doesn't exist yet.
+func NewStore(path string, key []byte) (*Store, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secret store key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		path:    path,
+		aead:    aead,
+		secrets: make(map[string]map[string]string),
+	}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// reload reads the store file again if it changed since it was last read or
+// written. Must be called with the lock held.
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.loaded != nil && info.ModTime().Equal(s.loaded.ModTime()) && info.Size() == s.loaded.Size() {
+		return nil
+	}
+
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	if len(content) < s.aead.NonceSize() {
+		return fmt.Errorf("secret store %s is corrupted", s.path)
+	}
+
+	nonce, ciphertext := content[:s.aead.NonceSize()], content[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't decrypt secret store %s, wrong key?", s.path)
+	}
+
+	secrets := make(map[string]map[string]string)
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return fmt.Errorf("couldn't load secret store %s: %w", s.path, err)
+	}
+
+	s.secrets = secrets
+	s.loaded = info
+
+	return nil
+}
+
+func (s *Store) Get(ctx context.Context, name string, key string) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.reload(); err != nil {
+		return "", err
+	}
+
+	v, ok := s.secrets[name][key]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return v, nil
+}
+
+// Set stores the value of key in the named secret
+func (s *Store) Set(ctx context.Context, name string, key string, value string) error {
+	if name == "" || key == "" || strings.Contains(name, "/") || strings.Contains(key, "/") {
+		return fmt.Errorf("%w: %s/%s", ErrInvalidReference, name, key)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	if s.secrets[name] == nil {
+		s.secrets[name] = make(map[string]string)
+	}
+	s.secrets[name][key] = value
+
+	return s.flush()
+}
+
+// Delete removes key from the named secret, or the whole secret when key is
+// empty.
+func (s *Store) Delete(ctx context.Context, name string, key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	if _, ok := s.secrets[name]; !ok {
+		return ErrNotFound
+	}
+
+	if key == "" {
+		delete(s.secrets, name)
+		return s.flush()
+	}
+
+	if _, ok := s.secrets[name][key]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.secrets[name], key)
+	if len(s.secrets[name]) == 0 {
+		delete(s.secrets, name)
+	}
+
+	return s.flush()
+}
+
+// flush encrypts the secrets with a fresh nonce and replaces the store file,
+// so a crash never leaves it half written. Must be called with the lock
+// held.
+func (s *Store) flush() error {
+	plaintext, err := json.Marshal(s.secrets)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	content := s.aead.Seal(nonce, nonce, plaintext, nil)
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.loaded = info
+
+	return nil
+}
@@ -0,0 +1,243 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrInvalidReference is returned for values using a secret scheme that
+	// can't be parsed.
+	ErrInvalidReference = errors.New("invalid secret reference")
+	// ErrNotFound is returned when a referenced secret doesn't exist
+	ErrNotFound = errors.New("secret not found")
+	// ErrForbiddenReference is returned for file:// and env:// references
+	// reading outside of what the server allows.
+	ErrForbiddenReference = errors.New("secret reference not allowed")
+)
+
+// Reference schemes accepted in env values
+const (
+	// SchemeSecret reads key of the named secret from the SecretProvider,
+	// e.g. secret://database/password
+	SchemeSecret = "secret://"
+	// SchemeFile reads a file of the server, e.g. file:///run/secrets/token
+	SchemeFile = "file://"
+	// SchemeEnv reads an environment variable of the server, e.g. env://TOKEN
+	SchemeEnv = "env://"
+)
+
+// SecretProvider holds named secrets, each one made of several keys
+type SecretProvider interface {
+	Get(ctx context.Context, name string, key string) (string, error)
+}
+
+// Reference points at a secret value, it's what's stored in place of the
+// value itself.
+type Reference struct {
+	Scheme string
+
+	// Name and Key are set for SchemeSecret references
+	Name string
+	Key  string
+
+	// Path is the file or variable read by SchemeFile and SchemeEnv
+	// references
+	Path string
+}
+
+// IsReference reports whether value uses one of the reference schemes
+func IsReference(value string) bool {
+	for _, scheme := range []string{SchemeSecret, SchemeFile, SchemeEnv} {
+		if strings.HasPrefix(value, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseReference parses a value using one of the reference schemes
+func ParseReference(value string) (*Reference, error) {
+	switch {
+	case strings.HasPrefix(value, SchemeSecret):
+		name, key, ok := strings.Cut(strings.TrimPrefix(value, SchemeSecret), "/")
+		if !ok || name == "" || key == "" || strings.Contains(key, "/") {
+			return nil, fmt.Errorf("%w: %s must look like secret://name/key", ErrInvalidReference, value)
+		}
+
+		return &Reference{Scheme: SchemeSecret, Name: name, Key: key}, nil
+	case strings.HasPrefix(value, SchemeFile):
+		path := strings.TrimPrefix(value, SchemeFile)
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%w: %s must use an absolute path", ErrInvalidReference, value)
+		}
+
+		return &Reference{Scheme: SchemeFile, Path: path}, nil
+	case strings.HasPrefix(value, SchemeEnv):
+		name := strings.TrimPrefix(value, SchemeEnv)
+		if name == "" {
+			return nil, fmt.Errorf("%w: %s must name a variable", ErrInvalidReference, value)
+		}
+
+		return &Reference{Scheme: SchemeEnv, Path: name}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s uses an unknown scheme", ErrInvalidReference, value)
+	}
+}
+
+// String returns the reference as written in env values
+func (r *Reference) String() string {
+	if r.Scheme == SchemeSecret {
+		return r.Scheme + r.Name + "/" + r.Key
+	}
+
+	return r.Scheme + r.Path
+}
+
+// ResolverOptions restrict what file:// and env:// references can read, so a
+// manifest can't read the server credentials. References of a scheme are
+// rejected while its allowlist is empty.
+type ResolverOptions struct {
+	// EnvPrefixes are the prefixes of the variables env:// references can
+	// read, e.g. JOBS_
+	EnvPrefixes []string
+
+	// FileRoots are the directories file:// references can read from, e.g.
+	// /run/secrets
+	FileRoots []string
+}
+
+// Resolver replaces references by the values they point at
+type Resolver struct {
+	provider SecretProvider
+	opts     ResolverOptions
+}
+
+// NewResolver returns a resolver reading secret:// references from provider.
+// provider can be nil, secret:// references then fail to resolve.
+func NewResolver(provider SecretProvider, opts ResolverOptions) *Resolver {
+	roots := make([]string, 0, len(opts.FileRoots))
+	for _, root := range opts.FileRoots {
+		roots = append(roots, realPath(root))
+	}
+	opts.FileRoots = roots
+
+	return &Resolver{provider: provider, opts: opts}
+}
+
+// allowsEnv reports whether env:// references can read name
+func (r *Resolver) allowsEnv(name string) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, prefix := range r.opts.EnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsFile reports whether file:// references can read path, symlinks are
+// followed so they can't point out of the allowed directories.
+func (r *Resolver) allowsFile(path string) bool {
+	if r == nil {
+		return false
+	}
+
+	path = realPath(path)
+	for _, root := range r.opts.FileRoots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// realPath returns path with its symlinks resolved, or just cleaned when it
+// can't be resolved, e.g. because it doesn't exist.
+func realPath(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+
+	return filepath.Clean(path)
+}
+
+// Resolve returns the value value points at, values that aren't references
+// are returned as is. Errors never include the resolved value.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+
+	ref, err := ParseReference(value)
+	if err != nil {
+		return "", err
+	}
+
+	switch ref.Scheme {
+	case SchemeSecret:
+		if r == nil || r.provider == nil {
+			return "", fmt.Errorf("can't resolve %s: no secret provider configured", ref)
+		}
+
+		v, err := r.provider.Get(ctx, ref.Name, ref.Key)
+		if err != nil {
+			return "", fmt.Errorf("can't resolve %s: %w", ref, err)
+		}
+
+		return v, nil
+	case SchemeFile:
+		if !r.allowsFile(ref.Path) {
+			return "", fmt.Errorf("can't resolve %s: %w, the path is outside of the allowed roots", ref, ErrForbiddenReference)
+		}
+
+		content, err := os.ReadFile(ref.Path)
+		if err != nil {
+			return "", fmt.Errorf("can't resolve %s: %w", ref, err)
+		}
+
+		// Files usually end with a newline that isn't part of the secret
+		return strings.TrimSuffix(string(content), "\n"), nil
+	default:
+		if !r.allowsEnv(ref.Path) {
+			return "", fmt.Errorf("can't resolve %s: %w, the variable doesn't have an allowed prefix", ref, ErrForbiddenReference)
+		}
+
+		v, ok := os.LookupEnv(ref.Path)
+		if !ok {
+			return "", fmt.Errorf("can't resolve %s: %w", ref, ErrNotFound)
+		}
+
+		return v, nil
+	}
+}
+
+// ResolveEnv returns a copy of env with every reference resolved, env itself
+// is left untouched so resolved values are never persisted with it.
+func (r *Resolver) ResolveEnv(ctx context.Context, env map[string]string) (map[string]string, error) {
+	if env == nil {
+		return nil, nil
+	}
+
+	resolved := make(map[string]string, len(env))
+	for k, v := range env {
+		value, err := r.Resolve(ctx, v)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", k, err)
+		}
+
+		resolved[k] = value
+	}
+
+	return resolved, nil
+}
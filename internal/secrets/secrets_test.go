@@ -0,0 +1,218 @@
+package secrets_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jnfrati/boquita/internal/secrets"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{value: "secret://database/password", valid: true},
+		{value: "secret://database"},
+		{value: "secret:///password"},
+		{value: "secret://database/nested/password"},
+		{value: "file:///run/secrets/token", valid: true},
+		{value: "file://relative/token"},
+		{value: "env://TOKEN", valid: true},
+		{value: "env://"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ref, err := secrets.ParseReference(tt.value)
+			if tt.valid && err != nil {
+				t.Fatalf("expected a valid reference, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, secrets.ErrInvalidReference) {
+				t.Fatalf("expected ErrInvalidReference, got %v", err)
+			}
+			if tt.valid && ref.String() != tt.value {
+				t.Fatalf("expected %s to round trip, got %s", tt.value, ref)
+			}
+		})
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "database"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "database", "password"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BOQUITA_TEST_TOKEN", "env-token")
+
+	env := map[string]string{
+		"PLAIN":    "value",
+		"PASSWORD": "secret://database/password",
+		"FILE":     "file://" + filepath.Join(dir, "token"),
+		"ENV":      "env://BOQUITA_TEST_TOKEN",
+	}
+
+	resolver := secrets.NewResolver(secrets.NewFileProvider(dir), secrets.ResolverOptions{
+		EnvPrefixes: []string{"BOQUITA_TEST_"},
+		FileRoots:   []string{dir},
+	})
+
+	resolved, err := resolver.ResolveEnv(ctx, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"PLAIN":    "value",
+		"PASSWORD": "hunter2",
+		"FILE":     "file-token",
+		"ENV":      "env-token",
+	}
+	for k, v := range expected {
+		if resolved[k] != v {
+			t.Fatalf("expected %s to resolve to %q, got %q", k, v, resolved[k])
+		}
+	}
+
+	if env["PASSWORD"] != "secret://database/password" {
+		t.Fatal("expected the original env to be left untouched")
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := secrets.NewResolver(nil, secrets.ResolverOptions{}).Resolve(ctx, "secret://database/password"); err == nil {
+		t.Fatal("expected an error without a secret provider")
+	}
+
+	resolver := secrets.NewResolver(secrets.NewFileProvider(t.TempDir()), secrets.ResolverOptions{
+		EnvPrefixes: []string{"BOQUITA_TEST_"},
+	})
+
+	if _, err := resolver.Resolve(ctx, "secret://database/password"); !errors.Is(err, secrets.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if _, err := resolver.Resolve(ctx, "secret://../password"); err == nil {
+		t.Fatal("expected secret names to stay inside the provider directory")
+	}
+
+	if _, err := resolver.Resolve(ctx, "env://BOQUITA_TEST_MISSING"); !errors.Is(err, secrets.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestResolveAllowlists(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	for _, dir := range []string{root, outside} {
+		if err := os.WriteFile(filepath.Join(dir, "token"), []byte("token"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "token"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JOBS_TOKEN", "job-token")
+	t.Setenv("SERVER_TOKEN", "server-token")
+
+	resolver := secrets.NewResolver(nil, secrets.ResolverOptions{
+		EnvPrefixes: []string{"JOBS_"},
+		FileRoots:   []string{root},
+	})
+
+	tests := []struct {
+		value string
+		err   error
+	}{
+		{value: "env://JOBS_TOKEN"},
+		{value: "env://SERVER_TOKEN", err: secrets.ErrForbiddenReference},
+		{value: "file://" + filepath.Join(root, "token")},
+		{value: "file://" + filepath.Join(outside, "token"), err: secrets.ErrForbiddenReference},
+		{value: "file://" + root + "/../" + filepath.Base(outside) + "/token", err: secrets.ErrForbiddenReference},
+		{value: "file://" + filepath.Join(root, "link"), err: secrets.ErrForbiddenReference},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			_, err := resolver.Resolve(ctx, tt.value)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if _, err := secrets.NewResolver(nil, secrets.ResolverOptions{}).Resolve(ctx, "env://JOBS_TOKEN"); !errors.Is(err, secrets.ErrForbiddenReference) {
+		t.Fatalf("expected env:// to be rejected without an allowlist, got %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	key := bytes.Repeat([]byte{7}, secrets.KeySize)
+
+	store, err := secrets.NewStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set(ctx, "database", "password", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte("hunter2")) {
+		t.Fatal("expected the store file to be encrypted")
+	}
+
+	reopened, err := secrets.NewStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := reopened.Get(ctx, "database", "password")
+	if err != nil || v != "hunter2" {
+		t.Fatalf("expected the stored secret, got %q, %v", v, err)
+	}
+
+	if _, err := secrets.NewStore(path, bytes.Repeat([]byte{8}, secrets.KeySize)); err == nil {
+		t.Fatal("expected an error opening the store with the wrong key")
+	}
+
+	if err := reopened.Delete(ctx, "database", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Get(ctx, "database", "password"); !errors.Is(err, secrets.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+
+	// Changes made through another store on the same file are read again
+	if _, err := store.Get(ctx, "database", "password"); !errors.Is(err, secrets.ErrNotFound) {
+		t.Fatalf("expected the delete to be seen by the first store, got %v", err)
+	}
+	if err := reopened.Set(ctx, "api", "token", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := store.Get(ctx, "api", "token"); err != nil || v != "abc" {
+		t.Fatalf("expected the new secret to be seen by the first store, got %q, %v", v, err)
+	}
+}
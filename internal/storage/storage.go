@@ -2,12 +2,19 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Storage holds items by id. Items are copied in and out, changing an item
+// returned by Get doesn't change the stored one until it's Set. Copies are
+// shallow, so slices of a stored item must only be changed through Update.
 type Storage[I any] interface {
 	Get(ctx context.Context, id string) (*I, error)
 	SearchBy(ctx context.Context, path string, value any) ([]I, error)
@@ -15,6 +22,11 @@ type Storage[I any] interface {
 
 	Set(ctx context.Context, id string, data *I) (err error)
 	Remove(ctx context.Context, id string) error
+
+	// Update applies fn to the stored item and stores the result, no other
+	// change to the item can happen in between. Nothing is stored when fn
+	// fails, the item is returned as stored together with the error.
+	Update(ctx context.Context, id string, fn func(*I) error) (*I, error)
 }
 
 type StorageType uint8
@@ -48,7 +60,9 @@ func (ms *MemoryStorage[I]) Get(ctx context.Context, id string) (*I, error) {
 	if !ok {
 		return nil, ErrNotFound
 	}
-	return data, nil
+
+	item := *data
+	return &item, nil
 }
 
 func (ms *MemoryStorage[I]) SearchBy(ctx context.Context, path string, value any) ([]I, error) {
@@ -87,6 +101,15 @@ func getFieldByPath(obj any, path string) (any, error) {
 	parts := strings.Split(path, ".")
 
 	for _, part := range parts {
+		// Nested structs can be referenced through pointers
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil, errors.New("nil pointer")
+			}
+
+			v = v.Elem()
+		}
+
 		if v.Kind() != reflect.Struct {
 			return nil, errors.New("not a struct")
 		}
@@ -122,10 +145,45 @@ func (ms *MemoryStorage[I]) Set(ctx context.Context, id string, data *I) error {
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
 
-	ms.data[id] = data
+	item := *data
+	ms.data[id] = &item
 
 	return nil
 }
+
+func (ms *MemoryStorage[I]) Update(ctx context.Context, id string, fn func(*I) error) (*I, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	return ms.update(id, fn, nil)
+}
+
+// update applies fn to a copy of the stored item and stores it once stored
+// accepts it. Must be called with the lock held.
+func (ms *MemoryStorage[I]) update(id string, fn func(*I) error, stored func(*I) error) (*I, error) {
+	data, ok := ms.data[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	item := *data
+	if err := fn(&item); err != nil {
+		current := *data
+		return &current, err
+	}
+
+	if stored != nil {
+		if err := stored(&item); err != nil {
+			current := *data
+			return &current, err
+		}
+	}
+
+	ms.data[id] = &item
+
+	result := item
+	return &result, nil
+}
 func (ms *MemoryStorage[I]) Remove(ctx context.Context, id string) error {
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
@@ -134,3 +192,159 @@ func (ms *MemoryStorage[I]) Remove(ctx context.Context, id string) error {
 
 	return nil
 }
+
+// flushDelay is how long changes to a FileStorage are batched before the
+// file is written.
+const flushDelay = time.Second
+
+// FileStorage is a MemoryStorage that persists its content as a JSON file, so
+// data survives restarts. Changes are written in batches at most every
+// flushDelay, Flush must be called before exiting to write the last ones.
+type FileStorage[I any] struct {
+	MemoryStorage[I]
+
+	path string
+
+	// encoded holds every item as it was last stored, so writing the file
+	// never reads items callers may be changing. It's guarded by the
+	// MemoryStorage lock.
+	encoded map[string]json.RawMessage
+	pending *time.Timer
+	err     error
+
+	// writeMux keeps two flushes from writing the file at the same time
+	writeMux sync.Mutex
+}
+
+// NewFileStorage loads the data stored at path, the file is created on the
+// first write if it doesn't exist yet.
+func NewFileStorage[I any](path string) (*FileStorage[I], error) {
+	fs := &FileStorage[I]{path: path}
+	fs.data = make(map[string]*I)
+	fs.encoded = make(map[string]json.RawMessage)
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &fs.encoded); err != nil {
+		return nil, fmt.Errorf("couldn't load storage file %s: %w", path, err)
+	}
+
+	for id, raw := range fs.encoded {
+		item := new(I)
+		if err := json.Unmarshal(raw, item); err != nil {
+			return nil, fmt.Errorf("couldn't load item %s of storage file %s: %w", id, path, err)
+		}
+		fs.data[id] = item
+	}
+
+	return fs, nil
+}
+
+// Set stores data and schedules a write of the file. It returns the error of
+// the previous write, if it failed.
+func (fs *FileStorage[I]) Set(ctx context.Context, id string, data *I) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	item := *data
+	fs.data[id] = &item
+	fs.encoded[id] = encoded
+
+	return fs.schedule()
+}
+
+func (fs *FileStorage[I]) Update(ctx context.Context, id string, fn func(*I) error) (*I, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	item, err := fs.update(id, fn, func(item *I) error {
+		encoded, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+
+		fs.encoded[id] = encoded
+		return nil
+	})
+	if err != nil {
+		return item, err
+	}
+
+	return item, fs.schedule()
+}
+
+func (fs *FileStorage[I]) Remove(ctx context.Context, id string) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	delete(fs.data, id)
+	delete(fs.encoded, id)
+
+	return fs.schedule()
+}
+
+// schedule makes sure a flush is pending. Must be called with the lock held.
+func (fs *FileStorage[I]) schedule() error {
+	if fs.pending == nil {
+		fs.pending = time.AfterFunc(flushDelay, func() {
+			_ = fs.Flush()
+		})
+	}
+
+	err := fs.err
+	fs.err = nil
+
+	return err
+}
+
+// Flush writes the pending changes to a temporary file and renames it over
+// the storage file, so a crash never leaves it half written.
+func (fs *FileStorage[I]) Flush() error {
+	fs.writeMux.Lock()
+	defer fs.writeMux.Unlock()
+
+	fs.mux.Lock()
+	if fs.pending != nil {
+		fs.pending.Stop()
+		fs.pending = nil
+	}
+	snapshot := make(map[string]json.RawMessage, len(fs.encoded))
+	for id, raw := range fs.encoded {
+		snapshot[id] = raw
+	}
+	fs.mux.Unlock()
+
+	err := fs.write(snapshot)
+	if err != nil {
+		fs.mux.Lock()
+		fs.err = err
+		fs.mux.Unlock()
+	}
+
+	return err
+}
+
+func (fs *FileStorage[I]) write(snapshot map[string]json.RawMessage) error {
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp := fs.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fs.path)
+}
@@ -0,0 +1,168 @@
+package storage_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/jnfrati/boquita/internal/storage"
+)
+
+type item struct {
+	Name string
+
+	Parent *item
+}
+
+func TestFileStorageSurvivesReload(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "items.json")
+
+	fs, err := storage.NewFileStorage[item](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Set(ctx, "a", &item{Name: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set(ctx, "b", &item{Name: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := storage.NewFileStorage[item](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := reloaded.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "first" {
+		t.Fatalf("expected first, got %s", got.Name)
+	}
+
+	if _, err := reloaded.Get(ctx, "b"); err != storage.ErrNotFound {
+		t.Fatalf("expected removed item to stay removed, got %v", err)
+	}
+}
+
+func TestFileStorageWritesItemsAsSet(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "items.json")
+
+	fs, err := storage.NewFileStorage[item](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := &item{Name: "stored"}
+	if err := fs.Set(ctx, "a", it); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes not followed by a Set aren't persisted
+	it.Name = "changed"
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := storage.NewFileStorage[item](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := reloaded.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "stored" {
+		t.Fatalf("expected stored, got %s", got.Name)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := t.Context()
+
+	files, err := storage.NewFileStorage[item](filepath.Join(t.TempDir(), "items.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory, err := storage.NewStorage[item](storage.StorageType_Memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, s := range map[string]storage.Storage[item]{"memory": memory, "file": files} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Update(ctx, "a", func(i *item) error { return nil }); !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+
+			if err := s.Set(ctx, "a", &item{Name: "first"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.Get(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Items are copies, changing them doesn't change the stored one
+			got.Name = "changed"
+
+			failed := errors.New("rejected")
+			got, err = s.Update(ctx, "a", func(i *item) error {
+				i.Name = "rejected"
+				return failed
+			})
+			if !errors.Is(err, failed) || got.Name != "first" {
+				t.Fatalf("expected the stored item back with the error, got %+v, %v", got, err)
+			}
+
+			got, err = s.Update(ctx, "a", func(i *item) error {
+				i.Name += " updated"
+				return nil
+			})
+			if err != nil || got.Name != "first updated" {
+				t.Fatalf("expected the updated item, got %+v, %v", got, err)
+			}
+
+			got, err = s.Get(ctx, "a")
+			if err != nil || got.Name != "first updated" {
+				t.Fatalf("expected the update to be stored, got %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSearchByNestedPointer(t *testing.T) {
+	ctx := t.Context()
+
+	ms, err := storage.NewStorage[item](storage.StorageType_Memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ms.Set(ctx, "a", &item{Name: "a", Parent: &item{Name: "root"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Set(ctx, "b", &item{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := ms.SearchBy(ctx, "Parent.Name", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 || found[0].Name != "a" {
+		t.Fatalf("expected only a to match, got %v", found)
+	}
+}
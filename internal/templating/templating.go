@@ -0,0 +1,158 @@
+package templating
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Context is the data args and env templates are expanded with
+type Context struct {
+	ExecutionId string
+	JobId       string
+	JobName     string
+
+	// ScheduledTime is when the execution was meant to run, e.g. the cron
+	// tick that triggered it.
+	ScheduledTime time.Time
+
+	// Attempt counts the runs of the execution, starting at 1
+	Attempt int
+}
+
+// funcs are the helpers available to templates, mostly date math on
+// ScheduledTime: {{ .ScheduledTime | add "-24h" | date }}
+var funcs = template.FuncMap{
+	// add shifts t by a time.ParseDuration duration
+	"add": func(d string, t time.Time) (time.Time, error) {
+		duration, err := time.ParseDuration(d)
+		if err != nil {
+			return t, err
+		}
+		return t.Add(duration), nil
+	},
+	// addDate shifts t by years, months and days
+	"addDate": func(years int, months int, days int, t time.Time) time.Time {
+		return t.AddDate(years, months, days)
+	},
+	// truncate rounds t down to a multiple of a duration, e.g. "1h"
+	"truncate": func(d string, t time.Time) (time.Time, error) {
+		duration, err := time.ParseDuration(d)
+		if err != nil {
+			return t, err
+		}
+		return t.Truncate(duration), nil
+	},
+	"startOfDay": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	},
+	"startOfMonth": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	},
+	"utc": func(t time.Time) time.Time {
+		return t.UTC()
+	},
+	// format formats t with a Go time layout
+	"format": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"date": func(t time.Time) string {
+		return t.Format(time.DateOnly)
+	},
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+	"unix": func(t time.Time) int64 {
+		return t.Unix()
+	},
+}
+
+// IsTemplate reports whether s needs to be expanded
+func IsTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// Validate checks s is a template that can be expanded, so broken templates
+// are rejected before any execution.
+func Validate(s string) error {
+	if !IsTemplate(s) {
+		return nil
+	}
+
+	t, err := parse(s)
+	if err != nil {
+		return err
+	}
+
+	// Unknown fields and wrongly typed helpers only fail when executed
+	return t.Execute(io.Discard, Context{ScheduledTime: time.Now(), Attempt: 1})
+}
+
+// Expand returns s with its template actions replaced
+func Expand(s string, data Context) (string, error) {
+	if !IsTemplate(s) {
+		return s, nil
+	}
+
+	t, err := parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// ExpandArgs returns a copy of args with every argument expanded
+func ExpandArgs(args []string, data Context) ([]string, error) {
+	if args == nil {
+		return nil, nil
+	}
+
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		v, err := Expand(arg, data)
+		if err != nil {
+			return nil, fmt.Errorf("args[%d]: %w", i, err)
+		}
+		expanded[i] = v
+	}
+
+	return expanded, nil
+}
+
+// ExpandEnv returns a copy of env with every value expanded
+func ExpandEnv(env map[string]string, data Context) (map[string]string, error) {
+	expanded := make(map[string]string, len(env))
+	for k, v := range env {
+		value, err := Expand(v, data)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", k, err)
+		}
+		expanded[k] = value
+	}
+
+	return expanded, nil
+}
+
+// Env returns the standard variables injected in every instance
+func Env(data Context) map[string]string {
+	return map[string]string{
+		"BOQUITA_EXECUTION_ID":   data.ExecutionId,
+		"BOQUITA_JOB_ID":         data.JobId,
+		"BOQUITA_JOB_NAME":       data.JobName,
+		"BOQUITA_SCHEDULED_TIME": data.ScheduledTime.Format(time.RFC3339),
+		"BOQUITA_ATTEMPT":        strconv.Itoa(data.Attempt),
+	}
+}
+
+func parse(s string) (*template.Template, error) {
+	return template.New("").Funcs(funcs).Option("missingkey=error").Parse(s)
+}
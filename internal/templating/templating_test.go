@@ -0,0 +1,83 @@
+package templating_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jnfrati/boquita/internal/templating"
+)
+
+func TestExpand(t *testing.T) {
+	data := templating.Context{
+		ExecutionId:   "exec-1",
+		JobId:         "job-1",
+		JobName:       "report",
+		ScheduledTime: time.Date(2025, 3, 1, 3, 30, 0, 0, time.UTC),
+		Attempt:       2,
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{template: "--static", expected: "--static"},
+		{template: "--execution={{ .ExecutionId }}", expected: "--execution=exec-1"},
+		{template: "{{ .JobName }}-{{ .Attempt }}", expected: "report-2"},
+		{template: "--day={{ .ScheduledTime | date }}", expected: "--day=2025-03-01"},
+		{template: "--from={{ .ScheduledTime | add \"-24h\" | startOfDay | rfc3339 }}", expected: "--from=2025-02-28T00:00:00Z"},
+		{template: "{{ .ScheduledTime | addDate 0 -1 0 | startOfMonth | format \"2006-01\" }}", expected: "2025-02"},
+		{template: "{{ .ScheduledTime | truncate \"1h\" | unix }}", expected: "1740798000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			got, err := templating.Expand(tt.template, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []string{
+		"plain",
+		"{{ .ScheduledTime | date }}",
+	}
+	for _, s := range valid {
+		if err := templating.Validate(s); err != nil {
+			t.Fatalf("expected %q to be valid, got %v", s, err)
+		}
+	}
+
+	invalid := []string{
+		"{{ .ScheduledTime",
+		"{{ .Unknown }}",
+		"{{ .ScheduledTime | add \"yesterday\" }}",
+		"{{ nope }}",
+	}
+	for _, s := range invalid {
+		if err := templating.Validate(s); err == nil {
+			t.Fatalf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	env := templating.Env(templating.Context{
+		ExecutionId:   "exec-1",
+		ScheduledTime: time.Date(2025, 3, 1, 3, 30, 0, 0, time.UTC),
+		Attempt:       1,
+	})
+
+	if env["BOQUITA_EXECUTION_ID"] != "exec-1" || env["BOQUITA_ATTEMPT"] != "1" {
+		t.Fatalf("unexpected env %v", env)
+	}
+
+	if env["BOQUITA_SCHEDULED_TIME"] != "2025-03-01T03:30:00Z" {
+		t.Fatalf("unexpected scheduled time %s", env["BOQUITA_SCHEDULED_TIME"])
+	}
+}
@@ -2,36 +2,72 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/robfig/cron/v3"
 
+	"github.com/jnfrati/boquita/internal/logger"
 	"github.com/jnfrati/boquita/internal/models"
 	"github.com/jnfrati/boquita/internal/queue"
+	"github.com/jnfrati/boquita/internal/schedule"
+	"github.com/jnfrati/boquita/internal/secrets"
 	"github.com/jnfrati/boquita/internal/storage"
+	"github.com/jnfrati/boquita/internal/templating"
 )
 
+// ErrConflict is returned when the request can't be applied on the current
+// state of the resource.
+var ErrConflict = errors.New("conflicting state")
+
+// Runner is the side of the executor the controller needs to act on
+// executions that already left the queue.
+type Runner interface {
+	// Validate rejects manifests the executor can't run
+	Validate(manifest *models.JobManifestV1) error
+
+	Cancel(ctx context.Context, execution *models.Execution) error
+
+	// Report applies a status change sent by the platform running the
+	// execution, token authenticates the platform.
+	Report(ctx context.Context, execution *models.Execution, token string, report *models.ExecutionReport) error
+}
+
+// Options tune how the controller schedules jobs
+type Options struct {
+	// Schedule are the syntax extensions accepted in cron expressions
+	Schedule schedule.ParserOptions
+
+	// DefaultJitter is the jitter window of jobs whose manifest doesn't set
+	// one, 0 disables it.
+	DefaultJitter time.Duration
+}
+
 func NewController(
-	qc queue.Client[models.Job],
+	qc queue.Client[models.Trigger],
+	runner Runner,
 	jobStorage storage.Storage[models.Job],
 	cronToJobStorage storage.Storage[models.CronToJob],
 	executionStorage storage.Storage[models.Execution],
+	opts Options,
 ) *Controller {
-	c := cron.New(
-		cron.WithParser(
-			cron.NewParser(
-				cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow,
-			),
-		),
-	)
+	// Jobs are registered with their parsed schedule, the cron manager never
+	// parses expressions itself
+	c := cron.New()
 
 	c.Start()
 
 	return &Controller{
 		cronManager:      c,
+		cronParser:       schedule.NewParser(opts.Schedule),
+		defaultJitter:    opts.DefaultJitter,
 		qc:               qc,
+		runner:           runner,
 		jobStorage:       jobStorage,
 		cronToJobStorage: cronToJobStorage,
 		executionStorage: executionStorage,
@@ -39,13 +75,24 @@ func NewController(
 }
 
 type Controller struct {
-	qc queue.Client[models.Job]
+	qc queue.Client[models.Trigger]
+
+	runner Runner
 
 	jobStorage       storage.Storage[models.Job]
 	executionStorage storage.Storage[models.Execution]
 	cronToJobStorage storage.Storage[models.CronToJob]
 
-	cronManager *cron.Cron
+	cronManager   *cron.Cron
+	cronParser    *schedule.Parser
+	defaultJitter time.Duration
+
+	// jobsMux serializes the changes of a job state and its cron entry,
+	// e.g. an update swapping the entry while a tick fires. pending holds
+	// the triggers enqueued while it's held, they're pushed once it's
+	// released so a full queue doesn't block every other caller.
+	jobsMux sync.Mutex
+	pending []*models.Trigger
 }
 
 func (c *Controller) ListJobs(ctx context.Context) ([]models.Job, error) {
@@ -53,10 +100,30 @@ func (c *Controller) ListJobs(ctx context.Context) ([]models.Job, error) {
 }
 
 func (c *Controller) CreateJob(ctx context.Context, payload *models.JobManifestV1) (string, error) {
+	if err := payload.Validate(); err != nil {
+		return "", err
+	}
+
+	if err := c.runner.Validate(payload); err != nil {
+		return "", err
+	}
+
+	if err := c.validateSchedule(payload); err != nil {
+		return "", err
+	}
+
+	c.jobsMux.Lock()
+	defer c.unlockJobs()
+
+	if err := c.checkNameAvailable(ctx, payload.Name, ""); err != nil {
+		return "", err
+	}
 
 	job := new(models.Job)
 
 	job.Id = uuid.NewString()
+	job.State = models.JobState_ACTIVE
+	job.CreatedAt = time.Now()
 	job.Manifest = payload
 
 	err := c.jobStorage.Set(ctx, job.Id, job)
@@ -64,45 +131,708 @@ func (c *Controller) CreateJob(ctx context.Context, payload *models.JobManifestV
 		return "", err
 	}
 
-	j := cron.FuncJob(func() {
-		if err := c.qc.Push(job); err != nil {
-			// Send an error or retry
+	if payload.RunNow {
+		if err := c.fire(ctx, job.Id, time.Now(), models.TriggerKind_SCHEDULE); err != nil {
+			return "", errors.Wrap(err, "couldn't run job")
 		}
-	})
+		return job.Id, nil
+	}
 
-	if payload.Cron != nil {
-		entryId, err := c.cronManager.AddFunc(*payload.Cron, j)
+	if err := c.schedule(ctx, job); err != nil {
+		_ = c.jobStorage.Remove(ctx, job.Id)
+		return "", err
+	}
+
+	return job.Id, nil
+}
+
+// Restore schedules again the jobs found in storage, it's meant to be called
+// once on startup. The runs missed while the server was down are caught up
+// according to the job catch up policy, paused jobs stay paused. Jobs that
+// can't be scheduled anymore, e.g. because the cron syntax accepted by the
+// server changed, are paused with the reason instead of stopping the server.
+func (c *Controller) Restore(ctx context.Context) error {
+	c.jobsMux.Lock()
+	defer c.unlockJobs()
+
+	if err := c.skipQueued(ctx); err != nil {
+		return err
+	}
+
+	jobs, err := c.jobStorage.List(ctx, 100, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		job, err := c.jobStorage.Get(ctx, j.Id)
 		if err != nil {
-			return "", errors.Wrap(err, "couldn't add cron execution")
+			return err
 		}
 
-		if err := c.cronToJobStorage.Set(ctx, uuid.NewString(), &models.CronToJob{
-			JobId:       job.Id,
-			CronEntryId: entryId,
+		if job.State == models.JobState_COMPLETED || job.Paused {
+			continue
+		}
+
+		err = c.catchUp(ctx, job, time.Now())
+		if err == nil {
+			err = c.reschedule(ctx, job)
+		}
+		if err == nil {
+			continue
+		}
+
+		logger.Global.Error().
+			Err(err).
+			Str("job_id", job.Id).
+			Msg("couldn't restore job, pausing it")
+
+		if err := c.pause(ctx, job, "couldn't restore: "+err.Error()); err != nil {
+			return errors.Wrapf(err, "couldn't pause job %s", job.Id)
+		}
+	}
+
+	return nil
+}
+
+// skipQueued marks the executions left in the queue by a previous run as
+// skipped, the queue only lives in memory so they would never leave it.
+func (c *Controller) skipQueued(ctx context.Context) error {
+	queued, err := c.executionStorage.SearchBy(ctx, "Status", models.ExecutionStatus_QUEUED)
+	if err != nil {
+		return err
+	}
+
+	for _, execution := range queued {
+		if _, err := c.executionStorage.Update(ctx, execution.Id, func(e *models.Execution) error {
+			return e.Transition(models.ExecutionStatus_SKIPPED, "server restarted before launch")
 		}); err != nil {
-			return "", errors.Wrap(err, "couldn't store the relationship between cron entry and job id")
+			return err
 		}
 	}
 
-	if payload.Schedule != nil {
-		cronExpr, err := cron.ParseStandard(*payload.Schedule)
+	return nil
+}
+
+// PauseJob stops scheduling jobId until it's resumed, reason is recorded on
+// the job. Executions already enqueued are left alone.
+func (c *Controller) PauseJob(ctx context.Context, jobId string, reason string) (*models.Job, error) {
+	c.jobsMux.Lock()
+	defer c.unlockJobs()
+
+	job, err := c.jobStorage.Get(ctx, jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.State == models.JobState_COMPLETED {
+		return nil, errors.Wrap(ErrConflict, "job already completed")
+	}
+
+	if job.Paused {
+		return nil, errors.Wrap(ErrConflict, "job already paused")
+	}
+
+	if err := c.pause(ctx, job, reason); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// pause unschedules job and records it as paused for reason. Must be called
+// with jobsMux held.
+func (c *Controller) pause(ctx context.Context, job *models.Job, reason string) error {
+	if err := c.unschedule(ctx, job.Id); err != nil {
+		return errors.Wrap(err, "couldn't unschedule job")
+	}
+
+	now := time.Now()
+	job.Paused = true
+	job.PausedReason = reason
+	job.PausedAt = &now
+
+	return c.jobStorage.Set(ctx, job.Id, job)
+}
+
+// ResumeJob schedules a paused job again, the ticks missed while paused are
+// never caught up. With runNow an execution is enqueued right away instead.
+func (c *Controller) ResumeJob(ctx context.Context, jobId string, runNow bool) (*models.Job, error) {
+	c.jobsMux.Lock()
+	defer c.unlockJobs()
+
+	job, err := c.jobStorage.Get(ctx, jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !job.Paused {
+		return nil, errors.Wrap(ErrConflict, "job isn't paused")
+	}
+
+	now := time.Now()
+	job.Paused = false
+	job.PausedReason = ""
+	job.PausedAt = nil
+
+	// Catching up on startup starts from here on
+	if job.Manifest.Cron != nil {
+		job.LastScheduledAt = &now
+	}
+
+	if err := c.jobStorage.Set(ctx, job.Id, job); err != nil {
+		return nil, err
+	}
+
+	if runNow {
+		if err := c.fire(ctx, job.Id, now, models.TriggerKind_MANUAL); err != nil {
+			return nil, errors.Wrap(err, "couldn't run job")
+		}
+
+		// One-shot jobs are completed once they ran
+		job, err = c.jobStorage.Get(ctx, jobId)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		if job.State == models.JobState_COMPLETED {
+			return job, nil
 		}
-		c.cronManager.Schedule(cronExpr, j)
 	}
 
-	return job.Id, nil
+	if err := c.reschedule(ctx, job); err != nil {
+		return nil, err
+	}
+
+	return c.jobStorage.Get(ctx, jobId)
 }
 
-func (c *Controller) GetById(ctx context.Context, jobId string) (*models.Job, error) {
+// UpdateJob replaces the manifest of jobId, its cron entry is swapped for one
+// following the new manifest. Completed jobs become active again, paused jobs
+// stay paused.
+func (c *Controller) UpdateJob(ctx context.Context, jobId string, payload *models.JobManifestV1) (*models.Job, error) {
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.runner.Validate(payload); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateSchedule(payload); err != nil {
+		return nil, err
+	}
+
+	c.jobsMux.Lock()
+	defer c.unlockJobs()
+
+	job, err := c.jobStorage.Get(ctx, jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkNameAvailable(ctx, payload.Name, job.Id); err != nil {
+		return nil, err
+	}
+
+	if err := c.unschedule(ctx, job.Id); err != nil {
+		return nil, errors.Wrap(err, "couldn't unschedule job")
+	}
+
+	now := time.Now()
+	job.Manifest = payload
+	job.State = models.JobState_ACTIVE
+	job.CompletedAt = nil
+	job.CompletedReason = ""
+
+	// Ticks of the new schedule before the update are never caught up
+	job.LastScheduledAt = nil
+	if payload.Cron != nil {
+		job.LastScheduledAt = &now
+	}
+
+	if err := c.jobStorage.Set(ctx, job.Id, job); err != nil {
+		return nil, err
+	}
+
+	if job.Paused {
+		return job, nil
+	}
+
+	if payload.RunNow {
+		if err := c.fire(ctx, job.Id, now, models.TriggerKind_SCHEDULE); err != nil {
+			return nil, errors.Wrap(err, "couldn't run job")
+		}
+	} else if err := c.reschedule(ctx, job); err != nil {
+		return nil, err
+	}
+
+	return c.jobStorage.Get(ctx, jobId)
+}
+
+// DeleteJob removes jobId and its cron entry. With cancelRunning its queued
+// and running executions are cancelled afterwards, with purge its finished
+// executions are removed too. Executions still running are always kept, so
+// their instances remain tracked.
+func (c *Controller) DeleteJob(ctx context.Context, jobId string, cancelRunning bool, purge bool) error {
+	executions, err := c.removeJob(ctx, jobId)
+	if err != nil {
+		return err
+	}
+
+	// Cancelling reaches the platform and retries, it's done without
+	// jobsMux so ticks and other calls aren't held by it. The job is gone
+	// already, nothing enqueues new executions of it meanwhile.
+	for _, execution := range executions {
+		if cancelRunning && !execution.Status.Terminal() {
+			_, err := c.CancelExecution(ctx, execution.Id, "")
+			// It may have finished in the meantime
+			if err != nil && !errors.Is(err, ErrConflict) {
+				return errors.Wrapf(err, "couldn't cancel execution %s", execution.Id)
+			}
+		}
+
+		if !purge {
+			continue
+		}
+
+		current, err := c.executionStorage.Get(ctx, execution.Id)
+		if err != nil {
+			return err
+		}
+
+		if current.Status.Terminal() {
+			if err := c.executionStorage.Remove(ctx, execution.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeJob unschedules and removes jobId, and returns its executions
+func (c *Controller) removeJob(ctx context.Context, jobId string) ([]models.Execution, error) {
+	c.jobsMux.Lock()
+	defer c.unlockJobs()
+
+	if _, err := c.jobStorage.Get(ctx, jobId); err != nil {
+		return nil, err
+	}
+
+	if err := c.unschedule(ctx, jobId); err != nil {
+		return nil, errors.Wrap(err, "couldn't unschedule job")
+	}
+
+	executions, err := c.executionStorage.SearchBy(ctx, "JobId", jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	return executions, c.jobStorage.Remove(ctx, jobId)
+}
+
+// checkNameAvailable returns ErrConflict when a job other than jobId is
+// already named name, names identify jobs for apply. Must be called with
+// jobsMux held.
+func (c *Controller) checkNameAvailable(ctx context.Context, name string, jobId string) error {
+	if name == "" {
+		return nil
+	}
+
+	jobs, err := c.jobStorage.SearchBy(ctx, "Manifest.Name", name)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.Id != jobId {
+			return errors.Wrapf(ErrConflict, "job %s is already named %s", job.Id, name)
+		}
+	}
+
+	return nil
+}
+
+// reschedule schedules job again after a restart or a pause. One-shot jobs
+// whose time already passed are run if their catch up policy allows it, and
+// completed without running otherwise.
+func (c *Controller) reschedule(ctx context.Context, job *models.Job) error {
+	now := time.Now()
+	scheduledAt := job.Manifest.ScheduledAt()
+
+	if !job.Manifest.OneShot() || scheduledAt.After(now) {
+		return c.schedule(ctx, job)
+	}
+
+	if job.Manifest.MissedRunDue(scheduledAt, now) {
+		return c.fire(ctx, job.Id, scheduledAt, models.TriggerKind_CATCH_UP)
+	}
+
+	logger.Global.Warn().
+		Str("job_id", job.Id).
+		Msg("one-shot job missed its schedule")
+
+	return c.complete(ctx, job, "missed schedule")
+}
+
+// maxCatchUp caps the missed runs enqueued at once for a job, the most
+// recent ones are kept.
+const maxCatchUp = 100
+
+// catchUp enqueues the runs of a cron job missed since its last scheduled
+// time, with their original scheduled time, according to its catch up
+// policy and starting deadline.
+func (c *Controller) catchUp(ctx context.Context, job *models.Job, now time.Time) error {
+	manifest := job.Manifest
+	if manifest.Cron == nil || manifest.CatchUpPolicy() == models.CatchUpPolicy_None {
+		return nil
+	}
+
+	from := job.CreatedAt
+	if job.LastScheduledAt != nil {
+		from = *job.LastScheduledAt
+	}
+
+	// Jobs stored before creation times were recorded
+	if from.IsZero() {
+		return nil
+	}
+
+	if deadline := manifest.StartingDeadlineOr(0); deadline > 0 && from.Before(now.Add(-deadline)) {
+		from = now.Add(-deadline)
+	}
+
+	s, err := c.cronParser.Parse(*manifest.Cron, manifest.TimezoneName())
+	if err != nil {
+		return err
+	}
+
+	// Ticks whose jittered time is still ahead will be run by the schedule
+	offset := c.jitter(job)
+
+	var missed []time.Time
+	dropped := 0
+	for t := s.Next(from); !t.IsZero() && !t.Add(offset).After(now); t = s.Next(t) {
+		missed = append(missed, t)
+		if len(missed) > maxCatchUp {
+			missed = missed[1:]
+			dropped++
+		}
+	}
+
+	if manifest.CatchUpPolicy() == models.CatchUpPolicy_Latest && len(missed) > 1 {
+		dropped += len(missed) - 1
+		missed = missed[len(missed)-1:]
+	}
+
+	if len(missed) == 0 {
+		return nil
+	}
+
+	logger.Global.Info().
+		Str("job_id", job.Id).
+		Int("runs", len(missed)).
+		Int("skipped", dropped).
+		Msg("catching up runs missed while the server was down")
+
+	for _, scheduledAt := range missed {
+		if err := c.fire(ctx, job.Id, scheduledAt, models.TriggerKind_CATCH_UP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schedule registers job on the cron manager according to its manifest,
+// either a cron expression or a one-shot time, and keeps track of the entry.
+func (c *Controller) schedule(ctx context.Context, job *models.Job) error {
+	var sched cron.Schedule
+	var offset time.Duration
+	switch {
+	case job.Manifest.Cron != nil:
+		s, err := c.cronParser.Parse(*job.Manifest.Cron, job.Manifest.TimezoneName())
+		if err != nil {
+			return fmt.Errorf("%w: cron_expr: %w", models.ErrInvalidManifest, err)
+		}
+		offset = c.jitter(job)
+		sched = schedule.Delay(s, offset)
+	case job.Manifest.OneShot() && !job.Manifest.RunNow:
+		sched = schedule.Once(job.Manifest.ScheduledAt())
+	default:
+		return nil
+	}
+
+	entryId := c.scheduleJob(sched, job.Id, offset)
+
+	if err := c.cronToJobStorage.Set(ctx, job.Id, &models.CronToJob{
+		JobId:       job.Id,
+		CronEntryId: entryId,
+	}); err != nil {
+		c.cronManager.Remove(entryId)
+		return errors.Wrap(err, "couldn't store the relationship between cron entry and job id")
+	}
+
+	return nil
+}
+
+// jitter returns the offset the ticks of job are delayed by, within its
+// jitter window. It only depends on the job id, so it stays the same across
+// restarts. Jobs running at an interval are never delayed, their ticks
+// aren't aligned on the clock.
+func (c *Controller) jitter(job *models.Job) time.Duration {
+	if job.Manifest.Cron == nil {
+		return 0
+	}
+
+	s, err := c.cronParser.Parse(*job.Manifest.Cron, job.Manifest.TimezoneName())
+	if err != nil || schedule.Interval(s) {
+		return 0
+	}
+
+	return schedule.Offset(job.Id, job.Manifest.JitterOr(c.defaultJitter))
+}
+
+// validateSchedule rejects manifests whose cron expression can't be parsed
+// with the syntax the controller accepts, jitter on @every intervals, and
+// one-shot jobs whose time already passed since they would never run.
+func (c *Controller) validateSchedule(manifest *models.JobManifestV1) error {
+	if manifest.OneShot() && manifest.Schedule != nil && !manifest.ScheduledAt().After(time.Now()) {
+		return fmt.Errorf("%w: schedule %s is in the past", models.ErrInvalidManifest, *manifest.Schedule)
+	}
+
+	if manifest.Cron == nil {
+		return nil
+	}
+
+	s, err := c.cronParser.Parse(*manifest.Cron, manifest.TimezoneName())
+	if err != nil {
+		return fmt.Errorf("%w: cron_expr: %w", models.ErrInvalidManifest, err)
+	}
+
+	if schedule.Interval(s) && manifest.JitterOr(0) > 0 {
+		return fmt.Errorf("%w: jitter can't be used with an @every interval", models.ErrInvalidManifest)
+	}
+
+	return nil
+}
+
+// unschedule removes the cron entry of jobId, if any
+func (c *Controller) unschedule(ctx context.Context, jobId string) error {
+	entry, err := c.cronToJobStorage.Get(ctx, jobId)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.cronManager.Remove(entry.CronEntryId)
+
+	return c.cronToJobStorage.Remove(ctx, jobId)
+}
+
+// scheduleJob registers jobId on the cron manager, every tick enqueues an
+// execution scheduled at the time of the tick. offset is the jitter the
+// schedule delays ticks by, the scheduled time is the tick before it.
+func (c *Controller) scheduleJob(schedule cron.Schedule, jobId string, offset time.Duration) cron.EntryID {
+	// The entry id is only known once registered, the first tick can't
+	// happen before that.
+	var entryId atomic.Int64
+
+	id := c.cronManager.Schedule(schedule, cron.FuncJob(func() {
+		// Prev is the tick being run, now is a bit late already
+		scheduledAt := c.cronManager.Entry(cron.EntryID(entryId.Load())).Prev
+		if scheduledAt.IsZero() {
+			scheduledAt = time.Now()
+		}
+		scheduledAt = scheduledAt.Add(-offset)
+
+		c.jobsMux.Lock()
+		defer c.unlockJobs()
+
+		if err := c.fire(context.Background(), jobId, scheduledAt, models.TriggerKind_SCHEDULE); err != nil {
+			logger.Global.Error().
+				Err(err).
+				Str("job_id", jobId).
+				Msg("couldn't enqueue scheduled execution")
+		}
+	}))
+	entryId.Store(int64(id))
+
+	return id
+}
+
+// unlockJobs releases jobsMux and pushes the triggers enqueued while it was
+// held.
+func (c *Controller) unlockJobs() {
+	pending := c.pending
+	c.pending = nil
+	c.jobsMux.Unlock()
+
+	for _, trigger := range pending {
+		if err := c.qc.Push(trigger); err != nil {
+			logger.Global.Error().
+				Err(err).
+				Str("execution_id", trigger.ExecutionId).
+				Msg("couldn't push queued execution")
+		}
+	}
+}
+
+// fire enqueues an execution of jobId scheduled at scheduledAt and records it
+// as the last scheduled time, one-shot jobs are completed right after. Must
+// be called with jobsMux held.
+func (c *Controller) fire(ctx context.Context, jobId string, scheduledAt time.Time, kind models.TriggerKind) error {
 	job, err := c.jobStorage.Get(ctx, jobId)
+	if err != nil {
+		return err
+	}
+
+	// A tick may already be running when the job is paused
+	if job.State == models.JobState_COMPLETED || job.Paused {
+		return nil
+	}
+
+	if err := c.enqueue(ctx, job, scheduledAt, kind); err != nil {
+		return err
+	}
+
+	if job.Manifest.OneShot() {
+		return c.complete(ctx, job, "ran once")
+	}
+
+	job.LastScheduledAt = &scheduledAt
+
+	return c.jobStorage.Set(ctx, job.Id, job)
+}
+
+// complete marks job as completed and stops scheduling it
+func (c *Controller) complete(ctx context.Context, job *models.Job, reason string) error {
+	now := time.Now()
+
+	job.State = models.JobState_COMPLETED
+	job.CompletedAt = &now
+	job.CompletedReason = reason
+
+	if err := c.jobStorage.Set(ctx, job.Id, job); err != nil {
+		return errors.Wrap(err, "couldn't store completed job")
+	}
+
+	return c.unschedule(ctx, job.Id)
+}
+
+// enqueue stores a new queued execution for job, its trigger is pushed once
+// jobsMux is released. Must be called with jobsMux held.
+func (c *Controller) enqueue(ctx context.Context, job *models.Job, scheduledAt time.Time, kind models.TriggerKind) error {
+	execution := models.NewExecution(uuid.NewString(), job.Id)
+	execution.ScheduledAt = scheduledAt
+	execution.TriggerKind = kind
+
+	// Catch up runs are enqueued right away, only ticks are delayed
+	if jitter := c.jitter(job); kind == models.TriggerKind_SCHEDULE && jitter > 0 {
+		execution.Jitter = jitter.String()
+	}
+
+	trigger, err := c.store(ctx, job, execution)
+	if err != nil {
+		return err
+	}
+
+	c.pending = append(c.pending, trigger)
+
+	return nil
+}
+
+// TriggerJob enqueues an execution of jobId right away, out of its schedule.
+// overrides only apply to the manifest of this execution, triggeredBy is
+// recorded on it. Paused and completed jobs can't be triggered, they're
+// resumed or updated first.
+func (c *Controller) TriggerJob(ctx context.Context, jobId string, triggeredBy string, overrides *models.TriggerOverrides) (*models.Execution, error) {
+	c.jobsMux.Lock()
+	defer c.unlockJobs()
+
+	job, err := c.jobStorage.Get(ctx, jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.State == models.JobState_COMPLETED {
+		return nil, errors.Wrap(ErrConflict, "job already completed")
+	}
+
+	if job.Paused {
+		return nil, errors.Wrap(ErrConflict, "job is paused")
+	}
+
+	// Overrides come from whoever can call the API, they can't read
+	// secrets the job manifest doesn't already reference, neither directly
+	// nor through a template
+	if overrides != nil {
+		for k, v := range overrides.Env {
+			if secrets.IsReference(v) {
+				return nil, fmt.Errorf("%w: env %s: trigger overrides can't reference secrets", models.ErrInvalidManifest, k)
+			}
+			if templating.IsTemplate(v) {
+				return nil, fmt.Errorf("%w: env %s: trigger overrides can't be templates", models.ErrInvalidManifest, k)
+			}
+		}
+	}
+
+	manifest := job.Manifest.WithOverrides(overrides)
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.runner.Validate(manifest); err != nil {
+		return nil, err
+	}
+
+	// The trigger carries its own copy of the job so the overrides never
+	// reach the stored manifest
+	run := *job
+	run.Manifest = manifest
+
+	execution := models.NewExecution(uuid.NewString(), job.Id)
+	execution.TriggerKind = models.TriggerKind_MANUAL
+	execution.TriggeredBy = triggeredBy
+	execution.Overrides = overrides
+
+	trigger, err := c.store(ctx, &run, execution)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: executions, err := c.executionStorage.SearchBy(ctx, ".JobId", job.Id)
-	executions, err := c.executionStorage.List(ctx, 100, 0)
+	c.pending = append(c.pending, trigger)
+
+	return execution, nil
+}
+
+// store stores execution as queued and returns the trigger running it with
+// job
+func (c *Controller) store(ctx context.Context, job *models.Job, execution *models.Execution) (*models.Trigger, error) {
+	execution.Platform = job.Manifest.PlatformName()
+
+	if err := c.executionStorage.Set(ctx, execution.Id, execution); err != nil {
+		return nil, errors.Wrap(err, "couldn't store queued execution")
+	}
+
+	return &models.Trigger{
+		ExecutionId: execution.Id,
+		Job:         job,
+	}, nil
+}
+
+func (c *Controller) GetById(ctx context.Context, jobId string) (*models.Job, error) {
+	stored, err := c.jobStorage.Get(ctx, jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Executions are only attached to the response, not to the stored job
+	job := *stored
+
+	executions, err := c.executionStorage.SearchBy(ctx, "JobId", job.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -113,15 +843,182 @@ func (c *Controller) GetById(ctx context.Context, jobId string) (*models.Job, er
 		slices.SortFunc(
 			job.Executions,
 			func(a models.Execution, b models.Execution) int {
-				return b.StartedAt.Compare(a.StartedAt)
+				return b.QueuedAt.Compare(a.QueuedAt)
 			},
 		)
 
 		job.LastExecution = &job.Executions[0]
 	}
-	return job, nil
+	return &job, nil
 }
 
-func (c *Controller) StreamJobLogs(ctx context.Context, jobId string) error {
-	return nil
+// CancelExecution stops an execution, either by discarding it while still
+// queued or by removing its instance when running. cancelledBy is recorded on
+// the execution.
+func (c *Controller) CancelExecution(ctx context.Context, executionId string, cancelledBy string) (*models.Execution, error) {
+	execution, err := c.executionStorage.Get(ctx, executionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if execution.Status.Terminal() {
+		return nil, errors.Wrap(ErrConflict, "execution already finished")
+	}
+
+	// Queued executions are skipped by the executor once marked as
+	// cancelled, only the ones that left the queue need the platform to act.
+	if execution.Status != models.ExecutionStatus_QUEUED {
+		if err := c.runner.Cancel(ctx, execution); err != nil {
+			return nil, errors.Wrap(err, "couldn't cancel running execution")
+		}
+	}
+
+	reason := "cancelled"
+	if cancelledBy != "" {
+		reason = "cancelled by " + cancelledBy
+	}
+
+	// The executor may have moved the execution on since it was read, the
+	// status only changes if it can still be cancelled. An execution that
+	// was launched in the meantime has its instance removed by the executor
+	// once it sees the cancellation.
+	execution, err = c.executionStorage.Update(ctx, executionId, func(e *models.Execution) error {
+		if err := e.Transition(models.ExecutionStatus_CANCELLED, reason); err != nil {
+			return errors.Wrap(ErrConflict, err.Error())
+		}
+
+		e.CancelledAt = e.FinishedAt
+		e.CancelledBy = cancelledBy
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return execution, nil
+}
+
+// ReportExecutionStatus applies a status report sent by the platform running
+// the execution, e.g. an executor plugin calling back.
+func (c *Controller) ReportExecutionStatus(ctx context.Context, executionId string, token string, report *models.ExecutionReport) (*models.Execution, error) {
+	execution, err := c.executionStorage.Get(ctx, executionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if execution.Status.Terminal() {
+		return nil, errors.Wrap(ErrConflict, "execution already finished")
+	}
+
+	if err := c.runner.Report(ctx, execution, token, report); err != nil {
+		if errors.Is(err, models.ErrInvalidTransition) {
+			return nil, errors.Wrap(ErrConflict, err.Error())
+		}
+		return nil, err
+	}
+
+	return c.executionStorage.Get(ctx, executionId)
+}
+
+// LatestExecution is the execution id accepted by StreamJobLogs to pick the
+// most recent execution of a job.
+const LatestExecution = "latest"
+
+// logsPollInterval is how often a followed execution is checked for new logs
+const logsPollInterval = time.Second
+
+// StreamJobLogs calls send with every log line of an execution of jobId, in
+// order. executionId can be LatestExecution to use the most recent one. When
+// follow is set it keeps sending new lines until the execution reaches a
+// terminal state, otherwise it returns once the stored lines are sent. The
+// execution as last seen is returned.
+func (c *Controller) StreamJobLogs(
+	ctx context.Context,
+	jobId string,
+	executionId string,
+	follow bool,
+	send func(line string) error,
+) (*models.Execution, error) {
+	execution, err := c.jobExecution(ctx, jobId, executionId)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(logsPollInterval)
+	defer ticker.Stop()
+
+	// sent is the index of the next line to send, counting the lines the
+	// executor already dropped to honor the log caps.
+	sent := 0
+	for {
+		var lines []string
+		lines, sent = unsentLogs(execution, sent)
+		for _, line := range lines {
+			if err := send(line); err != nil {
+				return execution, err
+			}
+		}
+
+		if !follow || execution.Status.Terminal() {
+			return execution, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return execution, ctx.Err()
+		case <-ticker.C:
+		}
+
+		execution, err = c.executionStorage.Get(ctx, execution.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unsentLogs returns the lines of execution from index sent on, and the index
+// following them. execution must be a snapshot read from storage, so its logs
+// and the count of lines dropped before them are consistent with each other.
+// Lines dropped before they could be sent are skipped.
+func unsentLogs(execution *models.Execution, sent int) ([]string, int) {
+	logs, dropped := execution.Logs, execution.LogsDropped
+
+	start := min(max(sent-dropped, 0), len(logs))
+	return logs[start:], dropped + len(logs)
+}
+
+// jobExecution returns the execution of jobId with executionId, or its most
+// recent one when executionId is LatestExecution.
+func (c *Controller) jobExecution(ctx context.Context, jobId string, executionId string) (*models.Execution, error) {
+	if _, err := c.jobStorage.Get(ctx, jobId); err != nil {
+		return nil, err
+	}
+
+	if executionId != LatestExecution {
+		execution, err := c.executionStorage.Get(ctx, executionId)
+		if err != nil {
+			return nil, err
+		}
+
+		if execution.JobId != jobId {
+			return nil, storage.ErrNotFound
+		}
+
+		return execution, nil
+	}
+
+	executions, err := c.executionStorage.SearchBy(ctx, "JobId", jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(executions) == 0 {
+		return nil, errors.Wrap(storage.ErrNotFound, "job has no executions")
+	}
+
+	latest := slices.MaxFunc(executions, func(a models.Execution, b models.Execution) int {
+		return a.QueuedAt.Compare(b.QueuedAt)
+	})
+
+	return c.executionStorage.Get(ctx, latest.Id)
 }
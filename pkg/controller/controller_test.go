@@ -2,25 +2,88 @@ package controller_test
 
 import (
 	"context"
-	"os"
+	"errors"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
-	"golang.org/x/sync/errgroup"
+	"github.com/google/uuid"
 
-	"github.com/jnfrati/boquita/internal/executor"
 	"github.com/jnfrati/boquita/internal/helpers"
 	"github.com/jnfrati/boquita/internal/models"
-	"github.com/jnfrati/boquita/internal/queue"
+	"github.com/jnfrati/boquita/internal/schedule"
 	"github.com/jnfrati/boquita/internal/storage"
 	"github.com/jnfrati/boquita/pkg/controller"
 )
 
-func setupTest(t *testing.T) *controller.Controller {
-	ctx := t.Context()
+// fakeRunner accepts every manifest and records the cancelled executions,
+// onCancel is called on every cancellation when set.
+type fakeRunner struct {
+	mux       sync.Mutex
+	cancelled []string
+	onCancel  func()
+}
+
+func (r *fakeRunner) Validate(manifest *models.JobManifestV1) error {
+	return nil
+}
+
+func (r *fakeRunner) Cancel(ctx context.Context, execution *models.Execution) error {
+	if r.onCancel != nil {
+		r.onCancel()
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.cancelled = append(r.cancelled, execution.Id)
+	return nil
+}
+
+func (r *fakeRunner) Report(ctx context.Context, execution *models.Execution, token string, report *models.ExecutionReport) error {
+	return nil
+}
+
+// fakeQueue records the pushed triggers, nothing ever pulls them
+type fakeQueue struct {
+	mux    sync.Mutex
+	pushed []*models.Trigger
+}
 
-	eg, ctx := errgroup.WithContext(ctx)
+func (q *fakeQueue) Push(trigger *models.Trigger) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
 
+	q.pushed = append(q.pushed, trigger)
+	return nil
+}
+
+func (q *fakeQueue) Pull(ctx context.Context) (*models.Trigger, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (q *fakeQueue) len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return len(q.pushed)
+}
+
+type testEnv struct {
+	controller *controller.Controller
+	queue      *fakeQueue
+	runner     *fakeRunner
+	jobs       storage.Storage[models.Job]
+	executions storage.Storage[models.Execution]
+}
+
+func setupTest(t *testing.T) *testEnv {
+	return setupTestWithOptions(t, controller.Options{})
+}
+
+func setupTestWithOptions(t *testing.T, opts controller.Options) *testEnv {
 	jobStorage, err := storage.NewStorage[models.Job](storage.StorageType_Memory)
 	if err != nil {
 		t.Fatal(err)
@@ -34,81 +97,715 @@ func setupTest(t *testing.T) *controller.Controller {
 		t.Fatal(err)
 	}
 
-	chanQueue := queue.NewChannelQueue[models.Job](uint8(100))
-
-	executor, err := executor.NewExecutor(
-		executor.ExecutorPlatform_UnikraftCloud,
-		chanQueue.Client(),
-		executionStorage,
-	)
-	if err != nil {
-		t.Fatal(err)
+	env := &testEnv{
+		queue:      new(fakeQueue),
+		runner:     new(fakeRunner),
+		jobs:       jobStorage,
+		executions: executionStorage,
 	}
 
-	controller := controller.NewController(
-		chanQueue.Client(),
+	env.controller = controller.NewController(
+		env.queue,
+		env.runner,
 		jobStorage,
 		cronToJobStorage,
 		executionStorage,
+		opts,
 	)
 
-	eg.Go(func() error {
-		return chanQueue.Start(ctx)
-	})
+	return env
+}
 
-	eg.Go(func() error {
-		return executor.Start(ctx)
-	})
+// cronManifest returns a manifest running hourly, so no tick happens while a
+// test runs.
+func cronManifest(name string) *models.JobManifestV1 {
+	return &models.JobManifestV1{
+		Name:     name,
+		Image:    "nginx:latest",
+		MemoryMB: helpers.Ptr(128),
+		Cron:     helpers.Ptr("0 * * * *"),
+		Timezone: helpers.Ptr("UTC"),
+	}
+}
 
-	go func() {
-		if err := eg.Wait(); err != nil {
-			t.Log(err)
-			t.Fail()
-		}
-	}()
+func runNowManifest(name string) *models.JobManifestV1 {
+	return &models.JobManifestV1{
+		Name:    name,
+		Version: models.JobManifestVersion_v1Schedule,
+		Image:   "nginx:latest",
+		RunNow:  true,
+	}
+}
+
+func (env *testEnv) createJob(t *testing.T, manifest *models.JobManifestV1) string {
+	t.Helper()
 
-	return controller
+	id, err := env.controller.CreateJob(t.Context(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
 }
 
 func TestCreateJob(t *testing.T) {
-	os.Setenv("UKC_TOKEN", "cm9ib3QkbmZyYXRpLnVzZXJzLmtyYWZ0Y2xvdWQ6dTM0UWZhUGcwdFVOUXh1WnRwbUl6S2JKTXoyc0dxOHo=")
-	os.Setenv("UKC_METRO", "fra0")
 	ctx := t.Context()
-	controller := setupTest(t)
+	env := setupTest(t)
+
+	id := env.createJob(t, cronManifest("hourly"))
+
+	job, err := env.controller.GetById(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	manifest := models.JobManifestV1{
-		Image:      "nginx:latest",
-		EnvMap:     map[string]string{},
-		Entrypoint: "./server",
-		MemoryMB:   helpers.Ptr(125),
-		Args:       []string{},
+	if job.State != models.JobState_ACTIVE {
+		t.Fatalf("expected an active job, got %s", job.State)
 	}
 
-	id, err := controller.CreateJob(context.Background(), &models.Job{
-		Name:     "test-job",
-		Version:  0,
-		Type:     models.JobType_SingleExecution,
-		Manifest: &manifest,
-	})
+	if env.queue.len() != 0 {
+		t.Fatalf("expected nothing enqueued before the first tick, got %d", env.queue.len())
+	}
+
+	if _, err := env.controller.CreateJob(ctx, cronManifest("hourly")); !errors.Is(err, controller.ErrConflict) {
+		t.Fatalf("expected a conflict for a duplicated name, got %v", err)
+	}
+}
+
+func TestGetById(t *testing.T) {
+	ctx := t.Context()
+	env := setupTest(t)
+	id := env.createJob(t, cronManifest("job"))
+	other := env.createJob(t, cronManifest("other"))
+
+	if _, err := env.controller.TriggerJob(ctx, id, "tester", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued last, it must not show up on the first job
+	if _, err := env.controller.TriggerJob(ctx, other, "tester", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := env.controller.GetById(ctx, id)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(5 * time.Second)
+	if len(job.Executions) != 1 || job.Executions[0].JobId != id {
+		t.Fatalf("expected only the execution of the job, got %+v", job.Executions)
+	}
+
+	if job.LastExecution == nil || job.LastExecution.JobId != id {
+		t.Fatalf("expected the last execution of the job, got %+v", job.LastExecution)
+	}
+}
+
+func TestCreateOneShotJob(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule time.Time
+		err      error
+	}{
+		{name: "ahead", schedule: time.Now().Add(time.Hour)},
+		{name: "past", schedule: time.Now().Add(-time.Minute), err: models.ErrInvalidManifest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := setupTest(t)
+
+			manifest := runNowManifest("once")
+			manifest.RunNow = false
+			manifest.Schedule = helpers.Ptr(tt.schedule.Format(time.RFC3339))
+
+			_, err := env.controller.CreateJob(t.Context(), manifest)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCreateJobJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		cron   string
+		jitter *string
+		err    error
+	}{
+		{name: "cron", cron: "0 * * * *", jitter: helpers.Ptr("5m")},
+		{name: "interval", cron: "@every 1h"},
+		{name: "interval without jitter", cron: "@every 1h", jitter: helpers.Ptr("0")},
+		{name: "interval with jitter", cron: "@every 1h", jitter: helpers.Ptr("5m"), err: models.ErrInvalidManifest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := setupTestWithOptions(t, controller.Options{
+				Schedule:      schedule.ParserOptions{Descriptors: true},
+				DefaultJitter: 10 * time.Minute,
+			})
+
+			manifest := cronManifest("job")
+			manifest.Cron = &tt.cron
+			manifest.Jitter = tt.jitter
+
+			_, err := env.controller.CreateJob(t.Context(), manifest)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestPauseJob(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest *models.JobManifestV1
+		pauses   int
+		err      error
+	}{
+		{name: "active", manifest: cronManifest("job"), pauses: 1},
+		{name: "already paused", manifest: cronManifest("job"), pauses: 2, err: controller.ErrConflict},
+		{name: "completed", manifest: runNowManifest("job"), pauses: 1, err: controller.ErrConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			env := setupTest(t)
+			id := env.createJob(t, tt.manifest)
+
+			var err error
+			for range tt.pauses {
+				_, err = env.controller.PauseJob(ctx, id, "maintenance")
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			job, err := env.controller.GetById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.err == nil && (!job.Paused || job.PausedReason != "maintenance") {
+				t.Fatalf("expected job paused for maintenance, got %+v", job)
+			}
+		})
+	}
+}
+
+func TestResumeJob(t *testing.T) {
+	tests := []struct {
+		name   string
+		pause  bool
+		runNow bool
+		pushed int
+		err    error
+	}{
+		{name: "not paused", err: controller.ErrConflict},
+		{name: "paused", pause: true},
+		{name: "run now", pause: true, runNow: true, pushed: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			env := setupTest(t)
+			id := env.createJob(t, cronManifest("job"))
+
+			if tt.pause {
+				if _, err := env.controller.PauseJob(ctx, id, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			job, err := env.controller.ResumeJob(ctx, id, tt.runNow)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if job.Paused {
+				t.Fatal("expected job to be resumed")
+			}
+
+			if env.queue.len() != tt.pushed {
+				t.Fatalf("expected %d executions enqueued, got %d", tt.pushed, env.queue.len())
+			}
+
+			for _, trigger := range env.queue.pushed {
+				execution, err := env.executions.Get(ctx, trigger.ExecutionId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if execution.TriggerKind != models.TriggerKind_MANUAL {
+					t.Fatalf("expected a manual execution, got %s", execution.TriggerKind)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateJob(t *testing.T) {
+	tests := []struct {
+		name string
+		to   string
+		err  error
+	}{
+		{name: "same name", to: "first"},
+		{name: "new name", to: "renamed"},
+		{name: "name of another job", to: "second", err: controller.ErrConflict},
+	}
 
-	job, err := controller.GetById(ctx, id)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			env := setupTest(t)
+			id := env.createJob(t, cronManifest("first"))
+			env.createJob(t, cronManifest("second"))
+
+			manifest := cronManifest(tt.to)
+			manifest.Image = "nginx:stable"
+
+			job, err := env.controller.UpdateJob(ctx, id, manifest)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if job.Manifest.Name != tt.to || job.Manifest.Image != "nginx:stable" {
+				t.Fatalf("expected the manifest to be replaced, got %+v", job.Manifest)
+			}
+		})
+	}
+}
+
+func TestDeleteJob(t *testing.T) {
+	tests := []struct {
+		name          string
+		cancelRunning bool
+		purge         bool
+		cancelled     int
+		remaining     []models.ExecutionStatus
+	}{
+		{
+			name:      "keep executions",
+			remaining: []models.ExecutionStatus{models.ExecutionStatus_RUNNING, models.ExecutionStatus_SUCCEEDED},
+		},
+		{
+			name:          "cancel running",
+			cancelRunning: true,
+			cancelled:     1,
+			remaining:     []models.ExecutionStatus{models.ExecutionStatus_CANCELLED, models.ExecutionStatus_SUCCEEDED},
+		},
+		{
+			name:      "purge",
+			purge:     true,
+			remaining: []models.ExecutionStatus{models.ExecutionStatus_RUNNING},
+		},
+		{
+			name:          "cancel running and purge",
+			cancelRunning: true,
+			purge:         true,
+			cancelled:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			env := setupTest(t)
+			id := env.createJob(t, cronManifest("job"))
+
+			for _, status := range []models.ExecutionStatus{models.ExecutionStatus_RUNNING, models.ExecutionStatus_SUCCEEDED} {
+				execution := models.NewExecution(uuid.NewString(), id)
+				for _, next := range []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING, status} {
+					if err := execution.Transition(next, ""); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := env.executions.Set(ctx, execution.Id, execution); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := env.controller.DeleteJob(ctx, id, tt.cancelRunning, tt.purge); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := env.controller.GetById(ctx, id); !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("expected job to be removed, got %v", err)
+			}
+
+			if len(env.runner.cancelled) != tt.cancelled {
+				t.Fatalf("expected %d executions cancelled, got %d", tt.cancelled, len(env.runner.cancelled))
+			}
+
+			executions, err := env.executions.SearchBy(ctx, "JobId", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remaining := make(map[models.ExecutionStatus]bool)
+			for _, execution := range executions {
+				remaining[execution.Status] = true
+			}
+			if len(remaining) != len(tt.remaining) {
+				t.Fatalf("expected executions %v, got %v", tt.remaining, remaining)
+			}
+			for _, status := range tt.remaining {
+				if !remaining[status] {
+					t.Fatalf("expected executions %v, got %v", tt.remaining, remaining)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteJobCancelsWithoutLock(t *testing.T) {
+	ctx := t.Context()
+	env := setupTest(t)
+	id := env.createJob(t, cronManifest("deleted"))
+	other := env.createJob(t, cronManifest("other"))
+
+	execution := models.NewExecution(uuid.NewString(), id)
+	for _, next := range []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING} {
+		if err := execution.Transition(next, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := env.executions.Set(ctx, execution.Id, execution); err != nil {
+		t.Fatal(err)
+	}
+
+	// The platform is slow to cancel, other jobs can change meanwhile
+	env.runner.onCancel = func() {
+		paused := make(chan error, 1)
+		go func() {
+			_, err := env.controller.PauseJob(ctx, other, "")
+			paused <- err
+		}()
+
+		select {
+		case err := <-paused:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("expected other jobs to be usable while executions are cancelled")
+		}
+	}
+
+	if err := env.controller.DeleteJob(ctx, id, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(env.runner.cancelled) != 1 {
+		t.Fatalf("expected the running execution to be cancelled, got %d", len(env.runner.cancelled))
+	}
+}
+
+func TestRestoreCatchUp(t *testing.T) {
+	hour := time.Now().UTC().Truncate(time.Hour)
+
+	tests := []struct {
+		name     string
+		policy   models.CatchUpPolicy
+		cron     string
+		lastTick time.Time
+		count    int
+		// missed are the expected scheduled times, when known in advance
+		missed []time.Time
+	}{
+		{
+			name:     "none",
+			policy:   models.CatchUpPolicy_None,
+			lastTick: hour.Add(-3 * time.Hour),
+		},
+		{
+			name:     "latest",
+			policy:   models.CatchUpPolicy_Latest,
+			lastTick: hour.Add(-3 * time.Hour),
+			count:    1,
+			missed:   []time.Time{hour},
+		},
+		{
+			name:     "all",
+			policy:   models.CatchUpPolicy_All,
+			lastTick: hour.Add(-3 * time.Hour),
+			count:    3,
+			missed:   []time.Time{hour.Add(-2 * time.Hour), hour.Add(-time.Hour), hour},
+		},
+		{
+			name:     "all capped",
+			policy:   models.CatchUpPolicy_All,
+			cron:     "* * * * *",
+			lastTick: hour.Add(-5 * time.Hour),
+			count:    100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			env := setupTest(t)
+
+			manifest := cronManifest("job")
+			manifest.CatchUp = helpers.Ptr(tt.policy)
+			if tt.cron != "" {
+				manifest.Cron = &tt.cron
+			}
+			id := env.createJob(t, manifest)
+
+			job, err := env.jobs.Get(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job.LastScheduledAt = &tt.lastTick
+			if err := env.jobs.Set(ctx, id, job); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := env.controller.Restore(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if env.queue.len() != tt.count {
+				t.Fatalf("expected %d executions caught up, got %d", tt.count, env.queue.len())
+			}
+
+			var last time.Time
+			for i, trigger := range env.queue.pushed {
+				execution, err := env.executions.Get(ctx, trigger.ExecutionId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if execution.TriggerKind != models.TriggerKind_CATCH_UP {
+					t.Fatalf("expected a catch up execution, got %s", execution.TriggerKind)
+				}
+				if tt.missed != nil && !execution.ScheduledAt.Equal(tt.missed[i]) {
+					t.Fatalf("expected run %d scheduled at %s, got %s", i, tt.missed[i], execution.ScheduledAt)
+				}
+				last = execution.ScheduledAt
+			}
+
+			// The most recent runs are the ones kept
+			if tt.count > 0 && time.Since(last) > time.Hour {
+				t.Fatalf("expected the latest missed run to be kept, got %s", last)
+			}
+		})
+	}
+}
+
+func TestRestorePausesBrokenJobs(t *testing.T) {
+	ctx := t.Context()
+	env := setupTest(t)
+
+	good := env.createJob(t, cronManifest("good"))
+
+	// e.g. stored while the server accepted a syntax it no longer does
+	broken := &models.Job{
+		Id:        uuid.NewString(),
+		State:     models.JobState_ACTIVE,
+		CreatedAt: time.Now(),
+		Manifest:  cronManifest("broken"),
+	}
+	broken.Manifest.Cron = helpers.Ptr("not a cron")
+	if err := env.jobs.Set(ctx, broken.Id, broken); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.controller.Restore(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := env.controller.GetById(ctx, broken.Id)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !job.Paused || job.PausedReason == "" {
+		t.Fatalf("expected broken job to be paused with a reason, got %+v", job)
+	}
 
-	if len(job.Executions) == 0 {
-		t.Log("No executions for this job")
+	job, err = env.controller.GetById(ctx, good)
+	if err != nil {
+		t.Fatal(err)
 	}
+	if job.Paused || job.State != models.JobState_ACTIVE {
+		t.Fatalf("expected good job to stay active, got %+v", job)
+	}
+}
 
-	for _, e := range job.Executions {
-		t.Logf("%v", e)
+func TestTriggerJob(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest *models.JobManifestV1
+		pause    bool
+		pushed   int
+		err      error
+	}{
+		{name: "active", manifest: cronManifest("job"), pushed: 1},
+		{name: "paused", manifest: cronManifest("job"), pause: true, err: controller.ErrConflict},
+		// Running it now pushed the one-shot execution already
+		{name: "completed", manifest: runNowManifest("job"), pushed: 1, err: controller.ErrConflict},
 	}
 
-	t.Logf("%v\n", job)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			env := setupTest(t)
+			id := env.createJob(t, tt.manifest)
+
+			if tt.pause {
+				if _, err := env.controller.PauseJob(ctx, id, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
 
+			execution, err := env.controller.TriggerJob(ctx, id, "tester", nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			if env.queue.len() != tt.pushed {
+				t.Fatalf("expected %d executions pushed, got %d", tt.pushed, env.queue.len())
+			}
+
+			if err == nil && (execution.TriggerKind != models.TriggerKind_MANUAL || execution.TriggeredBy != "tester") {
+				t.Fatalf("expected a manual execution triggered by tester, got %+v", execution)
+			}
+		})
+	}
+}
+
+func TestTriggerJobOverrides(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  error
+	}{
+		{name: "plain values", env: map[string]string{"MODE": "full"}},
+		{name: "env reference", env: map[string]string{"TOKEN": "env://UKC_TOKEN"}, err: models.ErrInvalidManifest},
+		{name: "file reference", env: map[string]string{"KEY": "file:///etc/shadow"}, err: models.ErrInvalidManifest},
+		{name: "secret reference", env: map[string]string{"PASSWORD": "secret://database/password"}, err: models.ErrInvalidManifest},
+		{name: "templated secret reference", env: map[string]string{"PASSWORD": `{{ "secret://database/password" }}`}, err: models.ErrInvalidManifest},
+		{name: "template", env: map[string]string{"RUN": "{{ .ExecutionId }}"}, err: models.ErrInvalidManifest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := setupTest(t)
+			id := env.createJob(t, cronManifest("job"))
+
+			_, err := env.controller.TriggerJob(t.Context(), id, "tester", &models.TriggerOverrides{Env: tt.env})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCancelExecution(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      []models.ExecutionStatus
+		cancelled int
+		err       error
+	}{
+		{name: "queued"},
+		{name: "running", path: []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING}, cancelled: 1},
+		{
+			name: "finished",
+			path: []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING, models.ExecutionStatus_SUCCEEDED},
+			err:  controller.ErrConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			env := setupTest(t)
+			id := env.createJob(t, cronManifest("job"))
+
+			execution := models.NewExecution(uuid.NewString(), id)
+			for _, next := range tt.path {
+				if err := execution.Transition(next, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := env.executions.Set(ctx, execution.Id, execution); err != nil {
+				t.Fatal(err)
+			}
+
+			cancelled, err := env.controller.CancelExecution(ctx, execution.Id, "tester")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			if len(env.runner.cancelled) != tt.cancelled {
+				t.Fatalf("expected the runner to cancel %d executions, got %d", tt.cancelled, len(env.runner.cancelled))
+			}
+
+			if err != nil {
+				return
+			}
+
+			stored, err := env.executions.Get(ctx, execution.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cancelled.Status != models.ExecutionStatus_CANCELLED || stored.Status != models.ExecutionStatus_CANCELLED || stored.CancelledBy != "tester" {
+				t.Fatalf("expected the execution to be stored as cancelled, got %+v", stored)
+			}
+		})
+	}
+}
+
+func TestStreamJobLogsFollow(t *testing.T) {
+	ctx := t.Context()
+	env := setupTest(t)
+	id := env.createJob(t, cronManifest("job"))
+
+	execution := models.NewExecution(uuid.NewString(), id)
+	for _, next := range []models.ExecutionStatus{models.ExecutionStatus_CREATING, models.ExecutionStatus_RUNNING} {
+		if err := execution.Transition(next, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	execution.AppendLogs([]string{"a", "b"}, 0, 0)
+	if err := env.executions.Set(ctx, execution.Id, execution); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	_, err := env.controller.StreamJobLogs(ctx, id, controller.LatestExecution, true, func(line string) error {
+		if len(sent) == 0 {
+			// The executor appends lines while the first ones are sent, dropping
+			// "c" before it can be sent
+			_, err := env.executions.Update(ctx, execution.Id, func(e *models.Execution) error {
+				e.AppendLogs([]string{"c", "d", "e"}, 2, 0)
+				return e.Transition(models.ExecutionStatus_SUCCEEDED, "")
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		sent = append(sent, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(sent, []string{"a", "b", "d", "e"}) {
+		t.Fatalf("expected a, b, d and e to be sent, got %v", sent)
+	}
 }